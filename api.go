@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// apiRR uses the rr_* requests of standalone boards
+	apiRR = "rr"
+
+	// apiREST uses the HTTP API of DSF on a Duet 3 with SBC
+	apiREST = "rest"
+
+	restConnectURL   = "/machine/connect?password="
+	restDirectoryURL = "/machine/directory/"
+	restFileURL      = "/machine/file/"
+	restStatusURL    = "/machine/status"
+	modelURL         = "/rr_model?flags=d99vno&key="
+	uploadURL        = "/rr_upload?name="
+	sessionKeyHeader = "X-Session-Key"
+)
+
+// apiMode selects the set of requests used to talk to the Duet
+var apiMode = apiRR
+
+// fileListRequestURL returns the URL to list the given remote directory
+func fileListRequestURL(baseURL, dir string) string {
+	if apiMode == apiREST {
+		return baseURL + restDirectoryURL + url.PathEscape(dir)
+	}
+	return baseURL + fileListURL + url.QueryEscape(dir)
+}
+
+// downloadRequestURL returns the URL to download the given remote file
+func downloadRequestURL(baseURL, remoteFilename string) string {
+	if apiMode == apiREST {
+		return baseURL + restFileURL + url.PathEscape(remoteFilename)
+	}
+	return baseURL + fileDownloadURL + url.QueryEscape(remoteFilename)
+}
+
+// upload stores content as the given remote file. Unless date is zero
+// it is passed along as the modification time of the file.
+func upload(baseURL, remoteFilename string, content []byte, date time.Time) error {
+	method, requestURL := http.MethodPost, baseURL+uploadURL+url.QueryEscape(remoteFilename)
+	if apiMode == apiREST {
+		method, requestURL = http.MethodPut, baseURL+restFileURL+url.PathEscape(remoteFilename)
+	}
+	if !date.IsZero() {
+		param := "&time="
+		if apiMode == apiREST {
+			param = "?timeModified="
+		}
+		requestURL += param + url.QueryEscape(date.Format("2006-01-02T15:04:05"))
+	}
+	return withRetries(requestURL, func() error {
+		req, err := http.NewRequest(method, requestURL, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		requestLimiter.Wait()
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			return &responseError{"unexpected response " + resp.Status, resp.StatusCode}
+		}
+
+		// RepRapFirmware reports failures in the err field
+		if apiMode == apiRR {
+			var result struct {
+				Err int `json:"err"`
+			}
+			if err = json.Unmarshal(body, &result); err != nil {
+				return fmt.Errorf("invalid upload response %q: %s", abbreviate(body, maxErrorBody), err)
+			}
+			if result.Err != 0 {
+				return fmt.Errorf("upload failed with error code %d", result.Err)
+			}
+		}
+		return nil
+	})
+}
+
+// queryModel reads the object model entry at the given dot-separated
+// key and unmarshals it into v. An empty key selects the whole model.
+// Standalone boards return just the requested part while DSF always
+// returns the whole object model.
+func queryModel(baseURL, key string, timeout time.Duration, v interface{}) error {
+	var body []byte
+	var err error
+	if apiMode == apiREST {
+		body, _, err = download(baseURL+restStatusURL, timeout)
+	} else {
+		body, _, err = download(baseURL+modelURL+url.QueryEscape(key), timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	var raw json.RawMessage
+	if apiMode == apiREST {
+		raw = body
+		for _, part := range strings.Split(key, ".") {
+			if part == "" {
+				continue
+			}
+			var obj map[string]json.RawMessage
+			if err = json.Unmarshal(raw, &obj); err != nil {
+				return fmt.Errorf("invalid object model: %s", err)
+			}
+
+			// Children of null values are null as well
+			if obj == nil {
+				break
+			}
+			raw = obj[part]
+		}
+	} else {
+		var resp struct {
+			Result json.RawMessage `json:"result"`
+		}
+		if err = json.Unmarshal(body, &resp); err != nil {
+			return fmt.Errorf("invalid object model response %q: %s", abbreviate(body, maxErrorBody), err)
+		}
+		raw = resp.Result
+	}
+	if raw == nil {
+		return fmt.Errorf("object model key %s not found", key)
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// volumeFreeSpace returns the free space in bytes reported for the
+// volume with the given index
+func volumeFreeSpace(baseURL string, volume int, timeout time.Duration) (uint64, error) {
+	var volumes []struct {
+		FreeSpace uint64 `json:"freeSpace"`
+	}
+	if err := queryModel(baseURL, "volumes", timeout, &volumes); err != nil {
+		return 0, err
+	}
+	if volume < 0 || volume >= len(volumes) {
+		return 0, fmt.Errorf("volume %d not found", volume)
+	}
+	return volumes[volume].FreeSpace, nil
+}
+
+var errWrongPassword = errors.New("the Duet rejected the password, please check -password and -passwordHash")
+
+// errTooManySessions is returned by connect if the Duet has no free session
+var errTooManySessions = errors.New("the Duet has no free session")
+
+// restConnect creates a session with DSF. If it returns a session key
+// it will be sent along with every following request.
+func restConnect(address, password string) error {
+	resp, err := httpClient.Get(address + restConnectURL + url.QueryEscape(password))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Older versions of DSF do not know about sessions at all
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return errWrongPassword
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("connect failed: " + resp.Status)
+	}
+
+	var session struct {
+		SessionKey string
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return err
+	}
+	if session.SessionKey != "" {
+		if t, ok := httpClient.Transport.(*headerTransport); ok {
+			t.header.Set(sessionKeyHeader, session.SessionKey)
+		}
+	}
+	return nil
+}
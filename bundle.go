@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// bundleFiles are the single files included in a bundle. They are
+// skipped if they do not exist.
+var bundleFiles = []string{"0:/sys/config.g", "0:/sys/config-override.g", "0:/sys/heightmap.csv"}
+
+// bundleDirs are included in a bundle with all files below them
+var bundleDirs = []string{"0:/macros"}
+
+const (
+	bundleManifestName = "manifest.json"
+	bundleModelName    = "model.json"
+)
+
+// bundleManifest describes the contents of a bundle
+type bundleManifest struct {
+	Created time.Time         `json:"created"`
+	Source  string            `json:"source"`
+	Model   string            `json:"model,omitempty"`
+	Files   []bundleFileEntry `json:"files"`
+}
+
+type bundleFileEntry struct {
+	Path   string    `json:"path"`
+	Remote string    `json:"remote"`
+	Size   int       `json:"size"`
+	Date   localTime `json:"date"`
+	SHA256 string    `json:"sha256"`
+}
+
+// writeBundle creates a zip archive with the configuration, macros,
+// height map and object model of the Duet together with a manifest
+// describing them
+func writeBundle(address, zipPath string, o *options) error {
+	tmp := zipPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	err = fillBundle(zw, address, o)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, zipPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func fillBundle(zw *zip.Writer, address string, o *options) error {
+	bm := bundleManifest{Created: time.Now(), Source: address}
+
+	// Collect the files with their remote information
+	var files []file
+	var paths []string
+	for _, dir := range bundleDirs {
+		fl, err := listTree(address, dir, o)
+		if err != nil {
+			log.Println("Skipping", dir+":", err)
+			continue
+		}
+		collectTreeFiles(fl, o, &files, &paths)
+	}
+	for _, p := range bundleFiles {
+		i := strings.LastIndex(p, "/")
+		fl, err := getFileList(address, p[:i], 0, o)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, f := range fl.Files {
+			if f.Type == typeFile && f.Name == p[i+1:] {
+				files, paths, found = append(files, f), append(paths, p), true
+			}
+		}
+		if !found {
+			o.info("Skipping", p, "since it does not exist")
+		}
+	}
+
+	for i, p := range paths {
+		body, _, err := download(downloadRequestURL(address, p), o.fileTimeout(files[i].Size))
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(p, sdRoot+"/")
+		if err = addToZip(zw, name, body, files[i].Date.Time); err != nil {
+			return err
+		}
+		bm.Files = append(bm.Files, bundleFileEntry{Path: name, Remote: p, Size: len(body), Date: files[i].Date, SHA256: sha256Hex(body)})
+		if o.verbose {
+			log.Println("  Bundled:   ", p)
+		}
+	}
+
+	// The object model is not essential so only warn if it is missing
+	var model json.RawMessage
+	if err := queryModel(address, "", o.listTimeout, &model); err != nil {
+		log.Println("Skipping object model:", err)
+	} else {
+		if err = addToZip(zw, bundleModelName, model, bm.Created); err != nil {
+			return err
+		}
+		bm.Model = bundleModelName
+	}
+
+	b, err := json.MarshalIndent(bm, "", "  ")
+	if err != nil {
+		return err
+	}
+	return addToZip(zw, bundleManifestName, b, bm.Created)
+}
+
+// collectTreeFiles appends all files of the tree that are not excluded
+func collectTreeFiles(fl *filelist, o *options, files *[]file, paths *[]string) {
+	for _, f := range fl.Files {
+		remotePath := fl.Dir + "/" + f.Name
+		if f.Type == typeDirectory || o.excls.Contains(remotePath) || o.ignored(remotePath) {
+			continue
+		}
+		*files = append(*files, f)
+		*paths = append(*paths, remotePath)
+	}
+	for _, sub := range fl.Subdirs {
+		collectTreeFiles(sub, o, files, paths)
+	}
+}
+
+// addToZip adds a file with the given content and date to the archive
+func addToZip(zw *zip.Writer, name string, content []byte, date time.Time) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: date})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// listingCache keeps directory listings of a Duet between runs.
+// All methods can be called on a nil listingCache in which case they
+// do nothing.
+type listingCache struct {
+	path  string
+	dirty bool
+
+	Created time.Time            `json:"created"`
+	Dirs    map[string]*filelist `json:"dirs"`
+}
+
+// listingCachePath returns the file the listings of the Duet at address
+// are cached in
+func listingCachePath(address string, showHidden bool) string {
+	key := address
+	if showHidden {
+		key += showHiddenParam
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(os.TempDir(), "duetbackup-listing-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// openListingCache loads the cached listings if they are not older than
+// maxAge. Otherwise or if refresh is set an empty cache is returned.
+func openListingCache(path string, maxAge time.Duration, refresh bool) *listingCache {
+	c := &listingCache{path: path}
+	if !refresh {
+		if b, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(b, c) == nil && time.Since(c.Created) <= maxAge {
+			return c
+		}
+	}
+	return &listingCache{path: path, Created: time.Now(), Dirs: make(map[string]*filelist)}
+}
+
+// Get returns a copy of the cached listing of dir
+func (c *listingCache) Get(dir string) (*filelist, bool) {
+	if c == nil {
+		return nil, false
+	}
+	fl, ok := c.Dirs[dir]
+	if !ok {
+		return nil, false
+	}
+	return &filelist{Dir: fl.Dir, Files: append([]file(nil), fl.Files...)}, true
+}
+
+// Put stores a copy of the listing of dir
+func (c *listingCache) Put(dir string, fl *filelist) {
+	if c == nil {
+		return
+	}
+	c.Dirs[dir] = &filelist{Dir: fl.Dir, Files: append([]file(nil), fl.Files...)}
+	c.dirty = true
+}
+
+// Delete drops the cached listing of dir
+func (c *listingCache) Delete(dir string) {
+	if c == nil {
+		return
+	}
+	if _, ok := c.Dirs[dir]; ok {
+		delete(c.Dirs, dir)
+		c.dirty = true
+	}
+}
+
+// Save writes the cache if anything was added
+func (c *listingCache) Save() error {
+	if c == nil || !c.dirty {
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// saveCache saves the cache and only warns about failures as the
+// cache is not essential
+func saveCache(c *listingCache) {
+	if err := c.Save(); err != nil {
+		log.Println("Failed to cache listings:", err)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// appendChangelog appends a one-line summary of a run to path. The line
+// is written with a single write to a file opened in append mode so lines
+// of concurrent runs do not interleave.
+func appendChangelog(path string, start time.Time, s *runStats, duration time.Duration, success bool) error {
+	line := fmt.Sprintf("%s added=%d updated=%d removed=%d skipped=%d bytes=%d duration=%s success=%t\n",
+		start.Format(time.RFC3339), s.added, s.updated, s.removed, s.skipped, s.bytes, duration.Round(time.Millisecond), success)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(line)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
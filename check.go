@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	colorGreen = "\x1b[32m"
+	colorRed   = "\x1b[31m"
+	colorReset = "\x1b[0m"
+)
+
+// checkReport prints the results of individual checks
+type checkReport struct {
+	color  bool
+	failed bool
+}
+
+func newCheckReport() *checkReport {
+	fi, err := os.Stdout.Stat()
+	return &checkReport{color: err == nil && fi.Mode()&os.ModeCharDevice != 0}
+}
+
+// result prints one line for a check. A nil error marks it as passed.
+func (r *checkReport) result(name string, err error) {
+	status, color, detail := "OK", colorGreen, ""
+	if err != nil {
+		status, color, detail = "FAIL", colorRed, ": "+err.Error()
+		r.failed = true
+	}
+	if r.color {
+		fmt.Printf("[%s%-4s%s] %s%s\n", color, status, colorReset, name, detail)
+	} else {
+		fmt.Printf("[%-4s] %s%s\n", status, name, detail)
+	}
+}
+
+// checkWritable verifies that a file can be created in dir. If dir does
+// not exist yet the closest existing parent is checked instead since
+// that is where it would be created.
+func checkWritable(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	f, err := ioutil.TempFile(dir, ".duetbackup-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// runChecks performs all checks without changing anything on the Duet or
+// in outDir and reports whether all of them passed. Additional output
+// files like metrics or journal are checked for writability as well.
+func runChecks(address, password, dirToBackup, outDir string, o *options, artifacts ...string) bool {
+	r := newCheckReport()
+
+	err := connect(address, password, o.verbose)
+	r.result("Connect to "+address, err)
+	if err != nil {
+		err = errors.New("skipped since not connected")
+	} else {
+		var fl *filelist
+		fl, err = getFileList(address, dirToBackup, 0, o)
+		if err == nil {
+			fmt.Printf("       %s contains %d entries\n", dirToBackup, len(fl.Files))
+		}
+	}
+	r.result("List "+dirToBackup, err)
+
+	r.result("Write to "+outDir, checkWritable(outDir))
+	for _, artifact := range artifacts {
+		if artifact != "" {
+			r.result("Write "+artifact, checkWritable(filepath.Dir(artifact)))
+		}
+	}
+
+	return !r.failed
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "os"
+
+const ownershipSupported = true
+
+// chown changes owner and group of path
+func chown(path string, uid, gid int) error {
+	return os.Chown(path, uid, gid)
+}
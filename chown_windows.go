@@ -0,0 +1,8 @@
+package main
+
+const ownershipSupported = false
+
+// chown does nothing on Windows as it has no Unix style ownership
+func chown(path string, uid, gid int) error {
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// maxClockSkew is the difference between the clocks of the Duet and this
+// host up to which they are considered in sync. The Duet reports its time
+// with a resolution of one second only.
+const maxClockSkew = 5 * time.Second
+
+// clockSkew returns how far the clock of the Duet is ahead of the clock of
+// this host. It fails if the Duet does not report a time, i.e. its clock
+// has not been set.
+func clockSkew(address string, o *options) (time.Duration, error) {
+	var duetTime string
+	before := time.Now()
+	if err := queryModel(address, "state.time", o.listTimeout, &duetTime); err != nil {
+		return 0, err
+	}
+	if duetTime == "" {
+		return 0, fmt.Errorf("the Duet did not report a time, its clock is not set")
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", duetTime, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %s", duetTime, err)
+	}
+
+	// Compare against the middle of the request and drop the fractional
+	// seconds the Duet does not report
+	now := before.Add(time.Since(before) / 2).Truncate(time.Second)
+	return t.Sub(now), nil
+}
+
+// checkClock logs the clock skew of the Duet and warns if it is too large
+// since remote modification times would be wrong then
+func checkClock(address string, o *options) {
+	skew, err := clockSkew(address, o)
+	switch {
+	case err != nil:
+		log.Println("Failed to check the clock of the Duet:", err)
+	case skew > maxClockSkew || skew < -maxClockSkew:
+		log.Println("The clock of the Duet is off by", skew, "although it was sent the current time on connect; modification times of changed files will be wrong")
+	default:
+		o.info("Clock of the Duet is in sync (skew", skew.String()+")")
+	}
+}
@@ -1,16 +1,18 @@
 #!/usr/bin/env fish
 
-env GOOS=linux GOARCH=arm go build duetbackup.go
+set ldflags "-X main.version="(git describe --tags --always)
+
+env GOOS=linux GOARCH=arm go build -ldflags $ldflags
 and tar czf duetbackup-linux_arm.tgz duetbackup LICENSE
 
-env GOOS=linux GOARCH=arm64 go build duetbackup.go
+env GOOS=linux GOARCH=arm64 go build -ldflags $ldflags
 and tar czf duetbackup-linux_arm64.tgz duetbackup LICENSE
 
-env GOOS=linux go build duetbackup.go
+env GOOS=linux go build -ldflags $ldflags
 and tar czf duetbackup-linux_amd64.tgz duetbackup LICENSE
 
-env GOOS=windows go build -o duetbackup.exe duetbackup.go
+env GOOS=windows go build -ldflags $ldflags -o duetbackup.exe
 and zip -r duetbackup-windows_amd64.zip duetbackup.exe LICENSE
 
-env GOOS=darwin go build duetbackup.go
+env GOOS=darwin go build -ldflags $ldflags
 and tar czf duetbackup-darwin_amd64.tgz duetbackup LICENSE
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+)
+
+// secretFlags are flags whose values are never printed
+var secretFlags = map[string]struct{}{
+	"password": {},
+}
+
+// printConfig writes the effective value of every flag followed by the
+// resolved exclude list
+func printConfig(w io.Writer, fs *flag.FlagSet, e *excludes) {
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if _, ok := secretFlags[f.Name]; ok && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(w, "%s = %s\n", f.Name, value)
+	})
+	fmt.Fprintln(w, "Effective excludes:")
+	for _, excl := range e.excls {
+		fmt.Fprintln(w, "  prefix:", excl)
+	}
+	for _, re := range e.regexes {
+		fmt.Fprintln(w, "  regex: ", re)
+	}
+}
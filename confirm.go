@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// needsRemoveConfirmation checks whether outDir already contains files
+// but neither a manifest nor a marker file of a previous run, i.e. it
+// might be the wrong directory to remove files from
+func needsRemoveConfirmation(outDir string) bool {
+	for _, name := range []string{manifestFile, dirMarker} {
+		if _, err := os.Stat(filepath.Join(outDir, name)); !os.IsNotExist(err) {
+			return false
+		}
+	}
+	return hasLocalFiles(outDir)
+}
+
+// isTerminal checks whether f is connected to a terminal
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks the question on stdout and reports whether the answer
+// read from stdin was yes
+func confirm(question string) bool {
+	fmt.Print(question + " [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const changesFile = "changes.txt"
+
+// collectFiles returns all regular files below root keyed by their
+// slash-separated path relative to root. Files created by duetbackup
+// itself are left out.
+func collectFiles(root string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || isOwnFile(fi.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = fi
+		return nil
+	})
+	return files, err
+}
+
+// sameContent compares the contents of two files byte by byte
+func sameContent(a, b string) (bool, error) {
+	ca, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false, err
+	}
+	cb, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ca, cb), nil
+}
+
+// writeChanges compares the backup in outDir against the one in prevDir
+// and writes a summary of added, removed and modified files to changesFile
+// inside outDir. It returns the number of changes found.
+func writeChanges(outDir, prevDir string) (int, error) {
+	current, err := collectFiles(outDir)
+	if err != nil {
+		return 0, err
+	}
+	previous, err := collectFiles(prevDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var changes []string
+	for name, fi := range current {
+		prev, exists := previous[name]
+		if !exists {
+			changes = append(changes, fmt.Sprintf("A %s (%+d bytes)", name, fi.Size()))
+			continue
+		}
+		if fi.Size() == prev.Size() {
+			same, err := sameContent(filepath.Join(outDir, name), filepath.Join(prevDir, name))
+			if err != nil {
+				return 0, err
+			}
+			if same {
+				continue
+			}
+		}
+		changes = append(changes, fmt.Sprintf("M %s (%+d bytes)", name, fi.Size()-prev.Size()))
+	}
+	for name, fi := range previous {
+		if _, exists := current[name]; !exists {
+			changes = append(changes, fmt.Sprintf("D %s (%+d bytes)", name, -fi.Size()))
+		}
+	}
+
+	// Sort by path, not by change type
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i][2:] < changes[j][2:]
+	})
+
+	f, err := os.Create(filepath.Join(outDir, changesFile))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "Changes compared to %s\n", prevDir)
+	for _, c := range changes {
+		fmt.Fprintln(w, c)
+	}
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(changes), f.Close()
+}
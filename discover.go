@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	mdnsAddress = "224.0.0.251:5353"
+	mdnsService = "_http._tcp.local"
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeSRV = 33
+	dnsClassIN = 1
+)
+
+var errInvalidDNSMessage = errors.New("invalid DNS message")
+
+// dnsRecord is the subset of a DNS resource record needed for discovery
+type dnsRecord struct {
+	name   string
+	rrType uint16
+	data   []byte
+
+	// offset of data inside the message to resolve compressed names
+	offset int
+}
+
+// buildMDNSQuery creates a DNS query message asking for PTR records
+// of the given service
+func buildMDNSQuery(service string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:], 1) // one question
+	for _, label := range strings.Split(service, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, dnsTypePTR, 0, dnsClassIN)
+	return msg
+}
+
+// readName decodes a possibly compressed domain name starting at off.
+// It returns the name and the offset right after it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errInvalidDNSMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errInvalidDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errInvalidDNSMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// parseDNSRecords returns all answer, authority and additional records
+// of a DNS message
+func parseDNSRecords(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, errInvalidDNSMessage
+	}
+	qdCount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrCount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qdCount; i++ {
+		_, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+	var records []dnsRecord
+	for i := 0; i < rrCount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(msg) {
+			return nil, errInvalidDNSMessage
+		}
+		rrType := binary.BigEndian.Uint16(msg[next:])
+		length := int(binary.BigEndian.Uint16(msg[next+8:]))
+		off = next + 10
+		if off+length > len(msg) {
+			return nil, errInvalidDNSMessage
+		}
+		records = append(records, dnsRecord{name: name, rrType: rrType, data: msg[off : off+length], offset: off})
+		off += length
+	}
+	return records, nil
+}
+
+// discover browses for HTTP services via mDNS and returns the address
+// (IP and port) of the first service instance whose name contains name.
+// It gives up after timeout.
+func discover(name string, timeout time.Duration) (string, uint64, error) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Using a random source port makes responders answer via unicast
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+	if _, err = conn.WriteToUDP(buildMDNSQuery(mdnsService), group); err != nil {
+		return "", 0, err
+	}
+
+	name = strings.ToLower(name)
+	instances := make(map[string]struct{})
+	targets := make(map[string]uint64)
+	hosts := make(map[string]net.IP)
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return "", 0, errors.New("no matching Duet found via mDNS")
+			}
+			return "", 0, err
+		}
+		msg := buf[:n]
+		records, err := parseDNSRecords(msg)
+		if err != nil {
+			continue
+		}
+		for _, r := range records {
+			switch r.rrType {
+			case dnsTypePTR:
+				instance, _, err := readName(msg, r.offset)
+				if err == nil && strings.Contains(strings.ToLower(instance), name) {
+					instances[strings.ToLower(instance)] = struct{}{}
+				}
+			case dnsTypeSRV:
+				if len(r.data) < 7 {
+					continue
+				}
+				if _, ok := instances[strings.ToLower(r.name)]; !ok && !strings.Contains(strings.ToLower(r.name), name) {
+					continue
+				}
+				target, _, err := readName(msg, r.offset+6)
+				if err == nil {
+					targets[strings.ToLower(target)] = uint64(binary.BigEndian.Uint16(r.data[4:]))
+				}
+			case dnsTypeA:
+				if len(r.data) == net.IPv4len {
+					hosts[strings.ToLower(r.name)] = net.IP(r.data)
+				}
+			}
+		}
+
+		// Records might arrive in separate messages so check after each one
+		for target, port := range targets {
+			if ip, ok := hosts[target]; ok {
+				return ip.String(), port, nil
+			}
+		}
+	}
+}
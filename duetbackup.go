@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -22,9 +34,59 @@ const (
 	typeFile        = "f"
 	fileDownloadURL = "/rr_download?name="
 	fileListURL     = "/rr_filelist?dir="
+	showHiddenParam = "&hidden=1"
+	firstParam      = "&first="
+	numResultsParam = "&numresults="
+	defaultPassword = "reprap"
 	dirMarker       = ".duetbackup"
+	relativePrefix  = "./"
+	idleConnTimeout = 90 * time.Second
+
+	// Traversal orders of syncFolder
+	orderDepthFirst   = "depthFirst"
+	orderBreadthFirst = "breadthFirst"
+	orderFilesLast    = "filesLast"
+
+	// connectRetryDelay is the time to wait between connection attempts
+	connectRetryDelay = 5 * time.Second
+
+	// sessionRetries is the number of times to wait for a free session
+	// and sessionRetryDelay the time to wait. The delay is longer than
+	// the default session timeout of RepRapFirmware so stale sessions
+	// have expired.
+	sessionRetries    = 6
+	sessionRetryDelay = 10 * time.Second
+
+	// maxErrorBody is the number of bytes of a response body that
+	// will be included in error messages
+	maxErrorBody = 200
+
+	// exitPartial is used if the run finished but not all files were
+	// handled, if it failed with an error or if another instance holds
+	// the lock
+	exitPartial = 1
+
+	// exitAuth is used if the Duet rejected the password
+	exitAuth = 2
+
+	// exitUnreachable is used if the Duet could not be contacted
+	exitUnreachable = 3
+
+	// exitConfig is used for invalid flags and settings
+	exitConfig = 4
+
+	// exitDrift is used by -assertCurrent and -verifyLocal if the
+	// backup is not current or corrupted
+	exitDrift = exitPartial
+
+	// incrementalOverlap is subtracted from the last successful run's time
+	// in incremental mode to not miss files modified while it was running
+	incrementalOverlap = 10 * time.Minute
 )
 
+// version is set at build time via -ldflags "-X main.version=..."
+var version = "dev"
+
 var multiSlashRegex = regexp.MustCompile(`/{2,}`)
 var httpClient *http.Client
 
@@ -34,17 +96,49 @@ type localTime struct {
 
 // file resembles the JSON object returned in the files property of the rr_filelist response
 type file struct {
-	Type string
-	Name string
-	Size uint64
-	Date localTime
+	Type string    `json:"type"`
+	Name string    `json:"name"`
+	Size fileSize  `json:"size"`
+	Date localTime `json:"date"`
 }
 
 // filelist resembled the JSON object in rr_filelist
 type filelist struct {
-	Dir   string
-	Files []file
-	next  uint64
+	Dir   string `json:"dir"`
+	Files []file `json:"files"`
+	Err   int    `json:"err,omitempty"`
+	Next  uint64 `json:"next,omitempty"`
+
+	// Subdirs is only populated when listing a whole tree
+	Subdirs []*filelist `json:"subdirs,omitempty"`
+}
+
+// hasFile checks whether the listing contains a file of the given name
+func (fl *filelist) hasFile(name string) bool {
+	for _, f := range fl.Files {
+		if f.Type != typeDirectory && f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSize is the size of a remote file. Some firmware versions send it
+// as a string instead of a number. A missing size (null) is taken as 0.
+type fileSize uint64
+
+func (fs *fileSize) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*fs = 0
+		return nil
+	}
+	str := strings.Trim(string(b), `"`)
+	size, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid file size %s", b)
+	}
+	*fs = fileSize(size)
+	return nil
 }
 
 func (lt *localTime) UnmarshalJSON(b []byte) (err error) {
@@ -53,29 +147,351 @@ func (lt *localTime) UnmarshalJSON(b []byte) (err error) {
 	return err
 }
 
+func (lt localTime) MarshalJSON() ([]byte, error) {
+	// Use the same format the Duet uses
+	return []byte(lt.Time.Format(`"2006-01-02T15:04:05"`)), nil
+}
+
+// options holds the settings that influence how a backup is performed
+type options struct {
+	excls       excludes
+	removeLocal bool
+	verbose     bool
+	quiet       bool
+	showHidden  bool
+	storeXattrs bool
+	deepVerify  bool
+
+	// storeCompressed makes local files be written gzipped with a .gz suffix
+	storeCompressed bool
+
+	// decompressGz makes remote .gz files be stored gunzipped without
+	// their suffix
+	decompressGz bool
+
+	// keepLocal selects local files that are never removed
+	keepLocal globPatterns
+
+	// readOnly selects local files that are made read-only
+	readOnly globPatterns
+
+	// order is the order in which syncFolder traverses the tree
+	order string
+
+	// validateConfig enables sanity checks of downloaded G-code files
+	validateConfig bool
+
+	// minAge defers files modified more recently than this
+	minAge time.Duration
+
+	// maxFilesPerDir skips directories with more files unless they are
+	// covered by allowLarge
+	maxFilesPerDir int
+	allowLarge     excludes
+
+	// dirToBackup is the remote root directory of the backup
+	dirToBackup string
+
+	// resume keeps partial downloads to continue them later
+	resume bool
+
+	// rateUnit and rateDecimals select how transfer rates are displayed
+	rateUnit     string
+	rateDecimals int
+
+	// deleteAfter delays removing local files until they have been missing
+	// on the Duet for this long
+	deleteAfter time.Duration
+
+	// downloadDeadline is the point in time after which no new
+	// downloads will be started
+	downloadDeadline time.Time
+
+	// pageSize is the number of entries requested per listing page
+	pageSize int
+
+	// streamThreshold is the size in bytes above which files are
+	// streamed to disk
+	streamThreshold uint64
+
+	// listTimeout and downloadTimeout limit the duration of a single
+	// listing or download request
+	listTimeout     time.Duration
+	downloadTimeout time.Duration
+
+	// minRate is the transfer rate in KiB/s a download must at least
+	// reach. If set the timeout of a download is baseTimeout plus the
+	// time needed to transfer the file at that rate.
+	minRate     float64
+	baseTimeout time.Duration
+
+	// recordListings collects the listing of every visited directory
+	// in listings
+	recordListings bool
+	listings       []*filelist
+
+	// ignores holds the ignore files of the directory being synced
+	// and its parents
+	ignores []ignoreFile
+
+	// cache holds directory listings of previous runs
+	cache *listingCache
+
+	// noUploadTime is set once the Duet rejected an upload that
+	// included the modification time
+	noUploadTime bool
+
+	// activeFile is the remote path of the file being printed
+	activeFile string
+
+	// continueOnError records failed files and directories in errs
+	// instead of aborting the run
+	continueOnError bool
+	errs            []error
+
+	// redact selects lines that are replaced before storing a file
+	redact redactPatterns
+
+	// timing records the duration of every download
+	timing *timingLog
+
+	// owner is applied to all created files and directories
+	owner ownership
+
+	// protected holds absolute paths of files that must never be removed
+	protected map[string]struct{}
+
+	// renames maps remote paths to paths relative to outRoot
+	renames renameMap
+	outRoot string
+
+	// since makes updateLocalFiles ignore all files not modified after it
+	since time.Time
+
+	// normalizeExts holds the extensions of files whose line endings
+	// will be normalized to LF; nil disables normalization
+	normalizeExts extensions
+
+	// m is the manifest of the current backup
+	m *manifest
+
+	// j records finished paths if resuming interrupted runs is enabled
+	j *journal
+
+	// stats collects numbers about the current run
+	stats runStats
+}
+
+// localName returns the name a remote file is stored under locally
+func (o *options) localName(name string) string {
+	if o.decompresses(name) {
+		return strings.TrimSuffix(name, compressedSuffix)
+	}
+	if o.storeCompressed {
+		return name + compressedSuffix
+	}
+	return name
+}
+
+// renamedRemotePath returns the remote path of a local file that was
+// stored elsewhere due to a rename rule
+func (o *options) renamedRemotePath(fileName string) (string, bool) {
+	rel, err := filepath.Rel(o.outRoot, fileName)
+	if err != nil {
+		return "", false
+	}
+	return o.renames.RemotePath(rel)
+}
+
+// localPath returns the local path for the given remote path. This is
+// defaultPath unless a rename rule matches the remote path.
+func (o *options) localPath(remotePath, defaultPath string) string {
+	if rel, ok := o.renames.LocalPath(remotePath); ok {
+		return filepath.Join(o.outRoot, rel)
+	}
+	return defaultPath
+}
+
+// protect adds the given file to the files that will never be removed
+func (o *options) protect(path string) {
+	if path == "" {
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	if o.protected == nil {
+		o.protected = make(map[string]struct{})
+	}
+	o.protected[path] = struct{}{}
+}
+
+// isProtected checks if the given absolute path must not be removed
+func (o *options) isProtected(path string) bool {
+	_, ok := o.protected[path]
+	return ok
+}
+
+// fileTimeout returns the timeout for downloading a file of the given size
+func (o *options) fileTimeout(size fileSize) time.Duration {
+	if o.minRate <= 0 {
+		return o.downloadTimeout
+	}
+	return o.baseTimeout + time.Duration(float64(size)/(o.minRate*1024)*float64(time.Second))
+}
+
+// outdated checks whether the local file fi is older than the remote file.
+// Files without a known date are always considered outdated. Comparing
+// with the mtime recorded when writing the file prevents downloading it
+// again and again on filesystems that round mtimes.
+func (o *options) outdated(remotePath string, remoteDate time.Time, fi os.FileInfo) bool {
+	return remoteDate.IsZero() ||
+		(!o.m.unchanged(remotePath, remoteDate, fi.ModTime()) && fi.ModTime().Before(remoteDate))
+}
+
+// fail aborts the run by returning the error unless continueOnError
+// is set. In that case the error is recorded and nil is returned. An
+// exhausted retry budget always aborts the run.
+func (o *options) fail(remotePath string, err error) error {
+	if !o.continueOnError || err == errRetryBudgetExhausted {
+		return err
+	}
+	err = fmt.Errorf("%s: %s", remotePath, err)
+	log.Println("  Failed:    ", err)
+	o.errs = append(o.errs, err)
+	return nil
+}
+
+// info logs informational messages unless quiet mode is enabled
+func (o *options) info(v ...interface{}) {
+	if !o.quiet {
+		log.Println(v...)
+	}
+}
+
 type excludes struct {
-	excls []string
+	excls      []string
+	regexes    []*regexp.Regexp
+	ignoreCase bool
 }
 
+// String joins all excludes by commas. Commas and backslashes within an
+// exclude are escaped by a backslash so Set can split them again.
 func (e *excludes) String() string {
-	return strings.Join(e.excls, ",")
+	escaped := make([]string, len(e.excls))
+	for i, excl := range e.excls {
+		escaped[i] = strings.Replace(strings.Replace(excl, `\`, `\\`, -1), ",", `\,`, -1)
+	}
+	return strings.Join(escaped, ",")
 }
 
+// Set adds one or more comma-separated excludes. A comma preceded by a
+// backslash is part of the exclude, as is a backslash preceded by one.
 func (e *excludes) Set(value string) error {
-	e.excls = append(e.excls, cleanPath(value))
+	for _, excl := range splitEscaped(value, ',') {
+		if excl != "" {
+			e.excls = append(e.excls, cleanPath(excl))
+		}
+	}
 	return nil
 }
 
+// splitEscaped splits s at every sep that is not escaped by a backslash
+// and removes the backslash of escaped separators and backslashes. Other
+// backslashes are kept as they are.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == sep || s[i+1] == '\\'):
+			part.WriteByte(s[i+1])
+			i++
+		case s[i] == sep:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// ResolveRelative turns excludes starting with "./" into excludes
+// anchored at the given root directory and drops duplicates
+func (e *excludes) ResolveRelative(root string) {
+	seen := make(map[string]struct{}, len(e.excls))
+	excls := e.excls[:0]
+	for _, excl := range e.excls {
+		if strings.HasPrefix(excl, relativePrefix) {
+			excl = cleanPath(root + "/" + strings.TrimPrefix(excl, relativePrefix))
+		}
+		if _, ok := seen[excl]; ok {
+			continue
+		}
+		seen[excl] = struct{}{}
+		excls = append(excls, excl)
+	}
+	e.excls = excls
+}
+
+// IgnoreCase makes all excludes match regardless of case
+func (e *excludes) IgnoreCase() {
+	e.ignoreCase = true
+	for i, re := range e.regexes {
+		e.regexes[i] = regexp.MustCompile("(?i)" + re.String())
+	}
+}
+
 // Contains checks if the given path starts with any of the known excludes
+// or matches any of the regular expression excludes
 func (e *excludes) Contains(path string) bool {
 	for _, excl := range e.excls {
+		if e.ignoreCase && strings.HasPrefix(strings.ToLower(path), strings.ToLower(excl)) {
+			return true
+		}
 		if strings.HasPrefix(path, excl) {
 			return true
 		}
 	}
+	for _, re := range e.regexes {
+		if re.MatchString(path) {
+			return true
+		}
+	}
 	return false
 }
 
+// regexExcludes adds regular expressions to excludes via the flag package
+type regexExcludes struct {
+	e *excludes
+}
+
+func (r regexExcludes) String() string {
+	if r.e == nil {
+		return ""
+	}
+	exprs := make([]string, 0, len(r.e.regexes))
+	for _, re := range r.e.regexes {
+		exprs = append(exprs, re.String())
+	}
+	return strings.Join(exprs, ",")
+}
+
+func (r regexExcludes) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	for _, known := range r.e.regexes {
+		if known.String() == value {
+			return nil
+		}
+	}
+	r.e.regexes = append(r.e.regexes, re)
+	return nil
+}
+
 // cleanPath will reduce multiple consecutive slashes into one and
 // then remove a trailing slash if any.
 func cleanPath(path string) string {
@@ -84,46 +500,214 @@ func cleanPath(path string) string {
 	return cleanedPath
 }
 
+// sameDir checks whether the directory reported in a listing refers to
+// the requested one. Firmware versions differ in whether they include
+// the drive and a trailing slash. An empty directory is not reported.
+func sameDir(requested, reported string) bool {
+	reported = cleanPath(reported)
+	if reported == "" || reported == cleanPath(requested) {
+		return true
+	}
+	if i := strings.Index(requested, ":"); i >= 0 && !strings.Contains(reported, ":") {
+		drive := requested[:i+1]
+		if !strings.HasPrefix(reported, "/") {
+			drive += "/"
+		}
+		return drive+reported == cleanPath(requested)
+	}
+	return false
+}
+
+// drivePath turns a remote path like 0:/sys into the relative local
+// path 0/sys including the drive as top-level directory
+func drivePath(remotePath string) string {
+	drive, dir := "", remotePath
+	if i := strings.Index(remotePath, ":"); i >= 0 {
+		drive, dir = remotePath[:i], remotePath[i+1:]
+	}
+	return filepath.Join(drive, filepath.FromSlash(dir))
+}
+
+// responseError reports a response that arrived but was not accepted as
+// opposed to a request that failed in transport
+type responseError struct {
+	msg string
+
+	// status is the HTTP status code if that signaled the error
+	status int
+}
+
+func (e *responseError) Error() string {
+	return e.msg
+}
+
 // download will perform a GET request on the given URL and return
 // the content of the response, a duration on how long it took (including
-// setup of connection) or an error in case something went wrong
-func download(url string) ([]byte, *time.Duration, error) {
-	start := time.Now()
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer resp.Body.Close()
+// setup of connection) or an error in case something went wrong.
+// Failed requests are repeated according to the retry policy.
+func download(url string, timeout time.Duration) ([]byte, *time.Duration, error) {
+	return downloadChecked(url, timeout, nil)
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	duration := time.Since(start)
+// downloadChecked works like download but additionally passes the
+// received body to check. If check returns an error the request is
+// retried like any other failed request.
+func downloadChecked(url string, timeout time.Duration, check func([]byte) error) ([]byte, *time.Duration, error) {
+	var body []byte
+	duration, err := downloadTo(url, timeout, func(r io.Reader) error {
+		var err error
+		body, err = ioutil.ReadAll(r)
+		if err == nil && check != nil {
+			err = check(body)
+		}
+		return err
+	})
 	if err != nil {
 		return nil, nil, err
 	}
-	return body, &duration, nil
+	return body, duration, nil
+}
+
+// downloadTo passes the response body to consume instead of reading it
+// into memory. consume is called again for every retry so it has to
+// start from scratch each time.
+func downloadTo(url string, timeout time.Duration, consume func(io.Reader) error) (*time.Duration, error) {
+	return downloadWith(url, timeout, nil, func(resp *http.Response) error {
+		return consume(resp.Body)
+	})
 }
 
-func getFileList(baseURL string, dir string, first uint64) (*filelist, error) {
+// downloadWith works like downloadTo but lets prepare modify every
+// request, e.g. to add a Range header, and passes the whole response to
+// consume. Partial content is accepted if a range was requested.
+func downloadWith(url string, timeout time.Duration, prepare func(*http.Request) error, consume func(*http.Response) error) (*time.Duration, error) {
+	var duration time.Duration
+	err := withRetries(url, func() error {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		if prepare != nil {
+			if err = prepare(req); err != nil {
+				return err
+			}
+		}
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+
+		requestLimiter.Wait()
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		// DSF signals errors only via the status code
+		if resp.StatusCode != http.StatusOK && (resp.StatusCode != http.StatusPartialContent || req.Header.Get("Range") == "") {
+			return &responseError{"unexpected response " + resp.Status, resp.StatusCode}
+		}
 
-	body, _, err := download(baseURL + fileListURL + dir)
+		err = consume(resp)
+		duration = time.Since(start)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	return &duration, nil
+}
+
+func getFileList(baseURL string, dir string, first uint64, o *options) (*filelist, error) {
+
+	// Reuse a recent listing if there is one
+	if first == 0 {
+		if fl, ok := o.cache.Get(dir); ok {
+			if o.verbose {
+				log.Println("  Using cached listing of", dir)
+			}
+			return fl, nil
+		}
+	}
+
+	listURL := fileListRequestURL(baseURL, dir)
+	if o.showHidden {
+		listURL += showHiddenParam
+	}
+	if apiMode == apiRR {
+		if first > 0 {
+			listURL += firstParam + strconv.FormatUint(first, 10)
+		}
+		if o.pageSize > 0 {
+			listURL += numResultsParam + strconv.Itoa(o.pageSize)
+		}
+	}
 
+	// A response that cannot be parsed is most likely truncated so
+	// request it again
 	var fl filelist
-	err = json.Unmarshal(body, &fl)
+	_, _, err := downloadChecked(listURL, o.listTimeout, func(body []byte) error {
+		fl = filelist{}
+		var err error
+		if apiMode == apiREST {
+			// DSF returns only the plain array of files
+			err = json.Unmarshal(body, &fl.Files)
+		} else {
+			err = json.Unmarshal(body, &fl)
+		}
+		if err != nil {
+			return &responseError{msg: fmt.Sprintf("invalid listing of %s (%s): %q", dir, err, abbreviate(body, maxErrorBody))}
+		}
+		return nil
+	})
+	if err == nil && fl.Err != 0 {
+		err = &responseError{msg: fmt.Sprintf("listing %s failed with error code %d", dir, fl.Err)}
+	}
+	if err == nil && !sameDir(dir, fl.Dir) {
+		log.Printf("  Listing of %s reported directory %q, using the requested one", dir, fl.Dir)
+	}
+	fl.Dir = dir
 	if err != nil {
-		return nil, err
+		// Only a response rejecting the request might be caused by the
+		// hidden flag. Transport errors have already been retried and
+		// say nothing about it.
+		if _, rejected := err.(*responseError); !rejected || !o.showHidden {
+			return nil, err
+		}
+
+		// The firmware might not like the hidden flag so do not use it anymore
+		log.Println("Listing hidden files is not supported, falling back to regular listing:", err)
+		o.showHidden = false
+		return getFileList(baseURL, dir, first, o)
 	}
 
-	// If the response signals there is more to fetch do it recursively
-	if fl.next > 0 {
-		moreFiles, err := getFileList(baseURL, dir, fl.next)
+	// If the response signals there is more to fetch do it recursively.
+	// This happens if the firmware caps the number of entries per page.
+	if fl.Next > 0 {
+		if fl.Next <= first {
+			return nil, fmt.Errorf("listing %s does not advance beyond entry %d", dir, first)
+		}
+		moreFiles, err := getFileList(baseURL, dir, fl.Next, o)
 		if err != nil {
 			return nil, err
 		}
 		fl.Files = append(fl.Files, moreFiles.Files...)
+		fl.Next = 0
+	}
+
+	// Drop entries that would end up outside of their directory
+	files := fl.Files[:0]
+	for _, f := range fl.Files {
+		if !isValidName(f.Name) {
+			log.Printf("  Ignoring invalid name %q in %s", f.Name, dir)
+			continue
+		}
+		files = append(files, f)
 	}
+	fl.Files = files
 
 	// Sort folders first and by name
 	sort.SliceStable(fl.Files, func(i, j int) bool {
@@ -136,12 +720,25 @@ func getFileList(baseURL string, dir string, first uint64) (*filelist, error) {
 		// Different types -> sort folders first
 		return fl.Files[i].Type == typeDirectory
 	})
+	if first == 0 {
+		o.cache.Put(dir, &fl)
+	}
 	return &fl, nil
 }
 
+// isValidName checks that a name returned by the Duet refers to an entry
+// directly inside the listed directory, i.e. it is not empty, contains
+// no path separators and is not a relative path component
+func isValidName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\`)
+}
+
 // ensureOutDirExists will create the local directory if it does not exist
 // and will in any case create the marker file inside it
-func ensureOutDirExists(outDir string, verbose bool) error {
+func ensureOutDirExists(outDir string, o *options) error {
 	path, err := filepath.Abs(outDir)
 	if err != nil {
 		return err
@@ -155,10 +752,10 @@ func ensureOutDirExists(outDir string, verbose bool) error {
 
 	// Create the directory
 	if fi == nil {
-		if verbose {
+		if o.verbose {
 			log.Println("  Creating directory", path)
 		}
-		if err = os.MkdirAll(path, 0755); err != nil {
+		if err = o.owner.mkdirAll(path); err != nil {
 			return err
 		}
 	}
@@ -173,9 +770,9 @@ func ensureOutDirExists(outDir string, verbose bool) error {
 	return nil
 }
 
-func updateLocalFiles(baseURL string, fl *filelist, outDir string, excls excludes, removeLocal, verbose bool) error {
+func updateLocalFiles(baseURL string, fl *filelist, outDir string, o *options) error {
 
-	if err := ensureOutDirExists(outDir, verbose); err != nil {
+	if err := ensureOutDirExists(outDir, o); err != nil {
 		return err
 	}
 
@@ -185,73 +782,436 @@ func updateLocalFiles(baseURL string, fl *filelist, outDir string, excls exclude
 		}
 		remoteFilename := fl.Dir + "/" + file.Name
 
-		// Skip files covered by an exclude pattern
-		if excls.Contains(remoteFilename) {
-			if verbose {
+		// Skip files covered by an exclude pattern or an ignore file
+		if o.excls.Contains(remoteFilename) || o.ignored(remoteFilename) {
+			if o.verbose {
 				log.Println("  Excluding: ", remoteFilename)
 			}
 			continue
 		}
 
-		fileName := filepath.Join(outDir, file.Name)
-		fi, err := os.Stat(fileName)
-		if err != nil && !os.IsNotExist(err) {
-			return err
+		o.stats.remoteBytes += uint64(file.Size)
+
+		// Never let a decompressed file replace a remote file of that name
+		if o.shadowsRemoteFile(fl, file.Name) {
+			log.Println("  Skipping", remoteFilename, "since its decompressed name exists on the Duet as well")
+			continue
 		}
 
-		// File does not exist or is outdated so get it
-		if fi == nil || fi.ModTime().Before(file.Date.Time) {
-			if verbose {
-			}
+		// Skip files already handled by an interrupted previous run
+		if o.j.Contains(remoteFilename) {
+			continue
+		}
+		o.stats.captured++
 
-			// Download file
-			body, duration, err := download(baseURL + fileDownloadURL + url.QueryEscape(remoteFilename))
-			if err != nil {
-				return err
-			}
-			if verbose {
-				kibs := (float64(file.Size) / duration.Seconds()) / 1024
-				if fi != nil {
-					log.Printf("  Updated:   %s (%.1f KiB/s)", remoteFilename, kibs)
-				} else {
-					log.Printf("  Added:     %s (%.1f KiB/s)", remoteFilename, kibs)
-				}
+		// Skip the file currently being printed to not get a partial copy
+		if o.activeFile != "" && remoteFilename == o.activeFile {
+			o.stats.skipped++
+			log.Println("  Skipped:   ", remoteFilename, "(in use)")
+			continue
+		}
+
+		// Skip files not modified since the last run in incremental mode
+		if !o.since.IsZero() && !file.Date.Time.IsZero() && !file.Date.Time.After(o.since) {
+			if o.verbose {
+				log.Println("  Unchanged: ", remoteFilename)
 			}
+			continue
+		}
 
-			// Open or create corresponding local file
-			nf, err := os.Create(fileName)
-			if err != nil {
+		fileName := o.localName(o.localPath(remoteFilename, filepath.Join(outDir, file.Name)))
+		if filepath.Dir(fileName) != outDir {
+			if err := ensureOutDirExists(filepath.Dir(fileName), o); err != nil {
 				return err
 			}
-			defer nf.Close()
+		}
+		// Never let a remote file replace a file of duetbackup itself, e.g.
+		// if the Duet serves a previous backup
+		if isOwnFile(filepath.Base(fileName)) || o.isProtected(fileName) {
+			log.Println("  Skipping", remoteFilename, "since it would overwrite", fileName)
+			continue
+		}
+
+		fi, err := os.Stat(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
 
-			// Write contents to local file
-			_, err = nf.Write(body)
-			if err != nil {
+		// Remote file used to be a directory so get rid of it if it is ours
+		if fi != nil && fi.IsDir() {
+			if !isManagedDirectory(filepath.Dir(fileName), fi) {
+				return fmt.Errorf("cannot replace directory %s by remote file %s: not managed by duetbackup", fileName, remoteFilename)
+			}
+			log.Println("  Replacing directory", fileName, "by file")
+			if err = os.RemoveAll(fileName); err != nil {
 				return err
 			}
+			fi = nil
+		}
+
+		// File does not exist or is outdated so get it
+		outdated := fi == nil || isPipeOrDevice(fi) || o.outdated(remoteFilename, file.Date.Time, fi)
 
-			// Adjust mtime
-			os.Chtimes(fileName, file.Date.Time, file.Date.Time)
+		// Skip changed files that might still be written to
+		if outdated && o.minAge > 0 && time.Since(file.Date.Time) < o.minAge {
+			o.stats.skipped++
+			log.Println("  Skipped:   ", remoteFilename, "(modified less than", o.minAge, "ago)")
+			continue
+		}
+		if outdated || o.deepVerify {
+			if !o.downloadDeadline.IsZero() && time.Now().After(o.downloadDeadline) {
+				o.stats.skipped++
+				if o.verbose {
+					log.Println("  Skipped:   ", remoteFilename, "(download deadline exceeded)")
+				}
+				continue
+			}
+			if err = fetchFile(baseURL, remoteFilename, fileName, file, fi, outdated, o); err != nil {
+				if err = o.fail(remoteFilename, err); err != nil {
+					return err
+				}
+				continue
+			}
 		} else {
-			if verbose {
+			// Record unchanged files as well so the manifest describes
+			// the whole backup, e.g. one made before it existed
+			o.record(remoteFilename, file, fi)
+			if o.verbose {
 				log.Println("  Up-to-date:", remoteFilename)
 			}
 		}
 
+		if err = o.j.Complete(remoteFilename); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// isManagedDirectory checks wether the given path is a directory and
-// if so if it contains the marker file. It will return false in case
-// any error has occured.
-func isManagedDirectory(basePath string, f os.FileInfo) bool {
-	if !f.IsDir() {
-		return false
+// hashRemoteFile downloads a remote file only to compute the hex encoded
+// SHA-256 hash of its content
+func hashRemoteFile(baseURL, remoteFilename string, file file, o *options) (string, error) {
+	var n int64
+	var h hash.Hash
+	duration, err := downloadTo(downloadRequestURL(baseURL, remoteFilename), o.fileTimeout(file.Size), func(r io.Reader) error {
+		var err error
+		h = sha256.New()
+		n, err = io.Copy(h, r)
+		return err
+	})
+	if err != nil {
+		return "", err
 	}
-	markerFile := filepath.Join(basePath, f.Name(), dirMarker)
+	if err = o.timing.Record(remoteFilename, int(n), *duration); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ensureParentDirs creates the parent directories of the given files.
+// Empty paths are ignored.
+func ensureParentDirs(paths ...string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeWritable restores the write permission of a local file that was
+// made read-only by -readOnlyPattern so it can be replaced
+func makeWritable(fileName string, fi os.FileInfo) error {
+	if fi == nil || !fi.Mode().IsRegular() || fi.Mode().Perm()&0200 != 0 {
+		return nil
+	}
+	return os.Chmod(fileName, fi.Mode().Perm()|0200)
+}
+
+// makeReadOnly removes all write permissions of the local file if it
+// matches -readOnlyPattern. On Windows this sets the read-only attribute.
+func (o *options) makeReadOnly(fileName string) error {
+	if len(o.readOnly) == 0 {
+		return nil
+	}
+	rel, err := filepath.Rel(o.outRoot, fileName)
+	if err != nil || !o.readOnly.Matches(rel) {
+		return nil
+	}
+	fi, err := os.Stat(fileName)
+	if err != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+	return os.Chmod(fileName, fi.Mode().Perm()&^0222)
+}
+
+// isPipeOrDevice checks if the file is a named pipe or a device
+func isPipeOrDevice(fi os.FileInfo) bool {
+	return fi.Mode()&(os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice) != 0
+}
+
+// openLocalFile opens the local file for writing. Regular files are
+// created or truncated. Existing named pipes and devices are opened for
+// writing without truncating them so their consumer receives the content.
+// Any other kind of existing non-regular file is rejected.
+func openLocalFile(fileName string, fi os.FileInfo) (*os.File, error) {
+	if fi == nil || fi.Mode().IsRegular() {
+		if err := makeWritable(fileName, fi); err != nil {
+			return nil, err
+		}
+		return os.Create(fileName)
+	}
+	if isPipeOrDevice(fi) {
+		return os.OpenFile(fileName, os.O_WRONLY, 0)
+	}
+	return nil, fmt.Errorf("cannot write to %s: not a regular file, named pipe or device (%s)", fileName, fi.Mode())
+}
+
+// fetchFile downloads a single remote file and writes it to fileName.
+// fi is the info of the existing local file or nil if there is none.
+// If the local file is not outdated the download is only used to verify
+// its content against the hash known from the manifest and it is only
+// written if that differs.
+func fetchFile(baseURL, remoteFilename, fileName string, file file, fi os.FileInfo, outdated bool, o *options) error {
+
+	// Compare the content of supposedly up-to-date files with the known
+	// hash without keeping it in memory
+	if !outdated {
+		sum, err := hashRemoteFile(baseURL, remoteFilename, file, o)
+		if err != nil {
+			return err
+		}
+		e := o.m.entry(remoteFilename)
+		switch e.SHA256 {
+		case sum:
+			if o.verbose {
+				log.Println("  Verified:  ", remoteFilename)
+			}
+			return nil
+		case "":
+			// Nothing to compare against yet
+			e.SHA256 = sum
+			if o.verbose {
+				log.Println("  Hashed:    ", remoteFilename)
+			}
+			return nil
+		}
+		log.Println("  Content of", remoteFilename, "differs from the known hash")
+		outdated = true
+	}
+
+	// Large files are written to disk while downloading
+	if outdated && o.streamable(file, fi) {
+		if err := streamFile(baseURL, remoteFilename, fileName, file, fi, o); err != nil {
+			return err
+		}
+		return finishFile(remoteFilename, fileName, file, fi, o)
+	}
+
+	// Download file
+	body, duration, err := download(downloadRequestURL(baseURL, remoteFilename), o.fileTimeout(file.Size))
+	if err != nil {
+		return err
+	}
+	if err = o.timing.Record(remoteFilename, len(body), *duration); err != nil {
+		return err
+	}
+
+	e := o.m.entry(remoteFilename)
+	e.SHA256 = sha256Hex(body)
+
+	o.countTransfer(remoteFilename, fi, uint64(len(body)), *duration)
+
+	// Decompress gzipped files and remember that we did so
+	if o.decompresses(file.Name) {
+		if body, err = gunzipContent(body); err != nil {
+			return fmt.Errorf("cannot decompress %s: %s", remoteFilename, err)
+		}
+		e.Decompressed = true
+	} else {
+		e.Decompressed = false
+	}
+
+	if o.validated(file.Name) {
+		for _, problem := range validateGcode(body, uint64(file.Size)) {
+			log.Println("  Warning:   ", remoteFilename+":", problem)
+		}
+	}
+
+	// Normalize line endings of text files and remember the original ones
+	if o.normalizeExts.Matches(file.Name) {
+		var normalized bool
+		body, normalized = normalizeLineEndings(body)
+		if normalized {
+			o.m.entry(remoteFilename).LineEndings = lineEndingsCRLF
+		} else if e, ok := o.m.Files[remoteFilename]; ok {
+			e.LineEndings = ""
+		}
+	}
+
+	// Remove sensitive lines and remember that we did so
+	var redacted int
+	body, redacted = redactLines(body, o.redact)
+	if redacted > 0 {
+		log.Printf("  Redacted %d lines of %s, the local copy cannot be restored as is", redacted, remoteFilename)
+		o.m.entry(remoteFilename).Redacted = true
+	} else if e, ok := o.m.Files[remoteFilename]; ok {
+		e.Redacted = false
+	}
+
+	// Compress contents and remember that we did so
+	if o.storeCompressed {
+		if body, err = gzipContent(body); err != nil {
+			return err
+		}
+		o.m.entry(remoteFilename).Compressed = true
+	} else if e, ok := o.m.Files[remoteFilename]; ok {
+		e.Compressed = false
+	}
+
+	// Open or create corresponding local file
+	nf, err := openLocalFile(fileName, fi)
+	if err != nil {
+		return err
+	}
+	defer nf.Close()
+
+	// Write contents to local file
+	_, err = nf.Write(body)
+	if err != nil {
+		return err
+	}
+
+	return finishFile(remoteFilename, fileName, file, fi, o)
+}
+
+// countTransfer updates the statistics for a downloaded file
+func (o *options) countTransfer(remoteFilename string, fi os.FileInfo, size uint64, duration time.Duration) {
+	if fi != nil {
+		o.stats.updated++
+	} else {
+		o.stats.added++
+	}
+	o.stats.bytes += size
+	if o.verbose {
+		rate := o.formatRate(size, duration)
+		if fi != nil {
+			log.Printf("  Updated:   %s (%s)", remoteFilename, rate)
+		} else {
+			log.Printf("  Added:     %s (%s)", remoteFilename, rate)
+		}
+	}
+}
+
+// finishFile applies ownership, modification time and extended
+// attributes to a written local file
+func finishFile(remoteFilename, fileName string, file file, fi os.FileInfo, o *options) error {
+	if err := o.owner.apply(fileName); err != nil {
+		return err
+	}
+	if err := o.makeReadOnly(fileName); err != nil {
+		return err
+	}
+	if err := o.removeUncompressed(remoteFilename, fileName); err != nil {
+		return err
+	}
+
+	// Pipes and devices have no meaningful mtime or attributes and
+	// without a known date there is nothing to apply
+	if (fi != nil && isPipeOrDevice(fi)) || file.Date.Time.IsZero() {
+		return nil
+	}
+
+	// Adjust mtime and remember what the filesystem made of it
+	os.Chtimes(fileName, file.Date.Time, file.Date.Time)
+	if nfi, err := os.Stat(fileName); err == nil {
+		o.record(remoteFilename, file, nfi)
+	}
+
+	if o.storeXattrs {
+		if err := storeXattrs(fileName, uint64(file.Size), file.Date.Time); err != nil {
+			log.Println("  Failed to store extended attributes of", fileName+":", err)
+		}
+	}
+
+	return nil
+}
+
+// record stores size and date of a remote file in the manifest along
+// with the modification time of its local copy fi
+func (o *options) record(remoteFilename string, file file, fi os.FileInfo) {
+	e := o.m.entry(remoteFilename)
+	e.Size = uint64(file.Size)
+	if !file.Date.Time.IsZero() {
+		remoteDate, localMtime := file.Date.Time, fi.ModTime()
+		e.RemoteDate, e.LocalMtime = &remoteDate, &localMtime
+	}
+}
+
+// removeUncompressed removes the uncompressed copy of a file written by
+// -storeCompressed, which was made before it was turned on. For a remote
+// .gz file that is the compressed copy of the file without the suffix if
+// that exists on the Duet too, so it is kept.
+func (o *options) removeUncompressed(remoteFilename, fileName string) error {
+	if !o.storeCompressed || !strings.HasSuffix(fileName, compressedSuffix) {
+		return nil
+	}
+	if strings.HasSuffix(remoteFilename, compressedSuffix) {
+		if e, ok := o.m.Files[strings.TrimSuffix(remoteFilename, compressedSuffix)]; ok && e.Compressed {
+			return nil
+		}
+	}
+	plain := strings.TrimSuffix(fileName, compressedSuffix)
+	if fi, err := os.Lstat(plain); err != nil || !fi.Mode().IsRegular() || o.isProtected(plain) {
+		return nil
+	}
+	if err := os.Remove(plain); err != nil {
+		return err
+	}
+	if o.verbose {
+		log.Println("  Removed uncompressed copy", plain)
+	}
+	return nil
+}
+
+// countFiles returns the number of files of a listing without directories
+func countFiles(fl *filelist) int {
+	n := 0
+	for _, f := range fl.Files {
+		if f.Type != typeDirectory {
+			n++
+		}
+	}
+	return n
+}
+
+// hasLocalFiles checks whether dir contains anything besides the files
+// of duetbackup itself
+func hasLocalFiles(dir string) bool {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, f := range files {
+		if !isOwnFile(f.Name()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isManagedDirectory checks wether the given path is a directory and
+// if so if it contains the marker file. It will return false in case
+// any error has occured.
+func isManagedDirectory(basePath string, f os.FileInfo) bool {
+	if !f.IsDir() {
+		return false
+	}
+	markerFile := filepath.Join(basePath, f.Name(), dirMarker)
 	fi, err := os.Stat(markerFile)
 	if err != nil && !os.IsNotExist(err) {
 		return false
@@ -262,30 +1222,117 @@ func isManagedDirectory(basePath string, f os.FileInfo) bool {
 	return true
 }
 
-func removeDeletedFiles(fl *filelist, outDir string, verbose bool) error {
+// isOwnFile checks whether the given file name is one of the files
+// duetbackup creates itself
+func isOwnFile(name string) bool {
+	switch name {
+	case dirMarker, lockFile, manifestFile, changesFile, restoreScriptSh, restoreScriptPs1:
+		return true
+	}
+	return false
+}
 
-	// Pseudo hash-set of known remote filenames
-	existingFiles := make(map[string]struct{})
+// localNames returns the names of the local files and directories in
+// outDir that belong to the remote listing fl including renamed files
+// of it that are stored in outDir
+func (o *options) localNames(fl *filelist, outDir string) map[string]struct{} {
+	names := make(map[string]struct{})
 	for _, f := range fl.Files {
-		existingFiles[f.Name] = struct{}{}
+		// The remote name is known as well, e.g. for an uncompressed
+		// copy made before -storeCompressed was used
+		names[f.Name] = struct{}{}
+		local := o.localPath(fl.Dir+"/"+f.Name, filepath.Join(outDir, f.Name))
+		if f.Type != typeDirectory {
+			names[o.localName(f.Name)] = struct{}{}
+			local = o.localName(local)
+		}
+		if filepath.Dir(local) == outDir {
+			names[filepath.Base(local)] = struct{}{}
+		}
 	}
+	return names
+}
+
+// keptLocally checks whether a local file or directory in outDir that is
+// not part of the remote listing fl is kept by -removeLocal nevertheless.
+// These are plain files and directories not managed by duetbackup, its
+// own and protected files, renamed files of other remote directories,
+// incomplete downloads that can be resumed and files matching -keepLocal.
+// The reason is only given if the file is kept by choice of the user.
+func (o *options) keptLocally(fl *filelist, outDir string, f os.FileInfo) (bool, string) {
+	fileName := filepath.Join(outDir, f.Name())
+	if remotePath, ok := o.renamedRemotePath(fileName); ok && path.Dir(remotePath) != fl.Dir {
+		return true, ""
+	}
+	if !isManagedDirectory(outDir, f) || isOwnFile(f.Name()) || (o.resume && isPartialFile(f.Name())) || o.isProtected(fileName) {
+		return true, ""
+	}
+	if rel, err := filepath.Rel(o.outRoot, fileName); err == nil && o.keepLocal.Matches(rel) {
+		return true, "matches -keepLocal"
+	}
+	return false, ""
+}
+
+// removeDeletedFiles removes local files and managed directories in
+// outDir that are not part of the remote listing fl anymore. It must
+// only be called once all downloads into outDir are complete and never
+// while anything else writes into outDir, since it decides based on a
+// snapshot of the directory contents.
+func removeDeletedFiles(fl *filelist, outDir string, o *options) error {
+	existingFiles := o.localNames(fl, outDir)
 
 	files, err := ioutil.ReadDir(outDir)
 	if err != nil {
 		return err
 	}
 
+	// Remember when we last saw the remote files to delay deletion
+	now := time.Now()
+	if o.deleteAfter > 0 {
+		for _, f := range fl.Files {
+			o.m.entry(fl.Dir + "/" + f.Name).LastSeen = &now
+		}
+	}
+
 	for _, f := range files {
 		if _, exists := existingFiles[f.Name()]; !exists {
 
-			// Skip directories not managed by us as well as our marker file
-			if !isManagedDirectory(outDir, f) || f.Name() == dirMarker {
+			if kept, reason := o.keptLocally(fl, outDir, f); kept {
+				if o.verbose && reason != "" {
+					log.Println("  Keeping:   ", f.Name(), "("+reason+")")
+				}
 				continue
 			}
+
+			remotePath := fl.Dir + "/" + f.Name()
+			if renamed, ok := o.renamedRemotePath(filepath.Join(outDir, f.Name())); ok {
+				remotePath = renamed
+			} else if o.storeCompressed && !f.IsDir() {
+				remotePath = strings.TrimSuffix(remotePath, compressedSuffix)
+			} else if e, ok := o.m.Files[remotePath+compressedSuffix]; ok && e.Decompressed && !f.IsDir() {
+				remotePath += compressedSuffix
+			}
+
+			// Keep files within the grace period
+			if o.deleteAfter > 0 {
+				e := o.m.entry(remotePath)
+				if e.LastSeen == nil {
+					e.LastSeen = &now
+				}
+				if now.Sub(*e.LastSeen) < o.deleteAfter {
+					if o.verbose {
+						log.Println("  Keeping:   ", f.Name(), "(deleted on the Duet, last seen", e.LastSeen.Format(time.RFC3339)+")")
+					}
+					continue
+				}
+			}
+
 			if err := os.RemoveAll(filepath.Join(outDir, f.Name())); err != nil {
 				return err
 			}
-			if verbose {
+			o.m.forget(remotePath)
+			o.stats.removed++
+			if o.verbose {
 				log.Println("  Removed:   ", f.Name())
 			}
 		}
@@ -294,28 +1341,27 @@ func removeDeletedFiles(fl *filelist, outDir string, verbose bool) error {
 	return nil
 }
 
-func syncFolder(address, folder, outDir string, excls excludes, removeLocal, verbose bool) error {
-
-	// Skip complete directories if they are covered by an exclude pattern
-	if excls.Contains(folder) {
-		log.Println("Excluding", folder)
-		return nil
-	}
-
-	log.Println("Fetching filelist for", folder)
-	fl, err := getFileList(address, url.QueryEscape(folder), 0)
-	if err != nil {
-		return err
+// syncFolder backs up the remote folder into outDir and then recurses
+// into its subdirectories. Directories are handled one after another
+// and for each of them removing deleted files only starts after all of
+// its downloads have finished, so -removeLocal never races with a
+// download into the same directory. -order selects whether files come
+// before or after the subdirectories or whether the tree is traversed
+// level by level.
+func syncFolder(address, folder, outDir string, o *options) error {
+	if o.order == orderBreadthFirst {
+		return syncFolderBreadthFirst(address, folder, outDir, o)
 	}
 
-	log.Println("Downloading new/changed files from", folder, "to", outDir)
-	if err = updateLocalFiles(address, fl, outDir, excls, removeLocal, verbose); err != nil {
+	errs := len(o.errs)
+	defer func(n int) { o.ignores = o.ignores[:n] }(len(o.ignores))
+	fl, err := openFolder(address, folder, outDir, o)
+	if err != nil || fl == nil {
 		return err
 	}
 
-	if removeLocal {
-		log.Println("Removing no longer existing files in", outDir)
-		if err = removeDeletedFiles(fl, outDir, verbose); err != nil {
+	if o.order != orderFilesLast {
+		if err = syncFiles(address, fl, outDir, o); err != nil {
 			return err
 		}
 	}
@@ -326,71 +1372,1125 @@ func syncFolder(address, folder, outDir string, excls excludes, removeLocal, ver
 			continue
 		}
 		remoteFilename := fl.Dir + "/" + file.Name
-		fileName := filepath.Join(outDir, file.Name)
-		if err = syncFolder(address, remoteFilename, fileName, excls, removeLocal, verbose); err != nil {
+		fileName := o.localPath(remoteFilename, filepath.Join(outDir, file.Name))
+
+		if err = syncFolder(address, remoteFilename, fileName, o); err != nil {
 			return err
 		}
 	}
 
-	return nil
-}
+	if o.order == orderFilesLast {
+		if err = syncFiles(address, fl, outDir, o); err != nil {
+			return err
+		}
+	}
 
-func getAddress(domain string, port uint64) string {
-	return "http://" + domain + ":" + strconv.FormatUint(port, 10)
+	// Folders with failures have to be visited again when resuming
+	if len(o.errs) > errs {
+		return nil
+	}
+	return o.j.Complete(dirEntry(folder))
 }
 
-func connect(address, password string, verbose bool) error {
-	if verbose {
-		log.Println("Trying to connect to Duet")
+// syncFolderBreadthFirst works like syncFolder but handles all
+// directories of one level before descending to the next one. Since a
+// directory is only complete once everything below it is, they are
+// recorded in the journal after the whole tree has been traversed.
+func syncFolderBreadthFirst(address, folder, outDir string, o *options) error {
+	type queued struct {
+		folder, outDir string
+		ignores        []ignoreFile
+		parent         int
+		visited        bool
+		failed         bool
 	}
-	path := "/rr_connect?password=" + url.QueryEscape(password) + "&time=" + url.QueryEscape(time.Now().Format("2006-01-02T15:04:05"))
-	_, err := httpClient.Get(address + path)
-	return err
+	initial := o.ignores
+	defer func() { o.ignores = initial }()
+
+	queue := []queued{{folder: folder, outDir: outDir, ignores: initial[:len(initial):len(initial)], parent: -1}}
+	for i := 0; i < len(queue); i++ {
+		o.ignores = queue[i].ignores
+		errs := len(o.errs)
+		fl, err := openFolder(address, queue[i].folder, queue[i].outDir, o)
+		if err != nil {
+			return err
+		}
+		if fl != nil {
+			queue[i].visited = true
+			if err = syncFiles(address, fl, queue[i].outDir, o); err != nil {
+				return err
+			}
+
+			// Subdirectories inherit the ignore files of their parents
+			ignores := o.ignores[:len(o.ignores):len(o.ignores)]
+			for _, file := range fl.Files {
+				if file.Type != typeDirectory {
+					continue
+				}
+				remoteFilename := fl.Dir + "/" + file.Name
+				fileName := o.localPath(remoteFilename, filepath.Join(queue[i].outDir, file.Name))
+				queue = append(queue, queued{folder: remoteFilename, outDir: fileName, ignores: ignores, parent: i})
+			}
+		}
+
+		// Folders with failures and their parents have to be visited
+		// again when resuming
+		if len(o.errs) > errs {
+			for p := i; p >= 0 && !queue[p].failed; p = queue[p].parent {
+				queue[p].failed = true
+			}
+		}
+	}
+
+	for i := len(queue) - 1; i >= 0; i-- {
+		if queue[i].visited && !queue[i].failed {
+			if err := o.j.Complete(dirEntry(queue[i].folder)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func main() {
-	var domain, dirToBackup, outDir, password string
-	var removeLocal, verbose bool
-	var port uint64
-	var excls excludes
+// openFolder fetches the listing of the remote folder and prepares outDir
+// for it. Ignore files found in the folder are added to o.ignores. It
+// returns nil if the folder is to be skipped.
+func openFolder(address, folder, outDir string, o *options) (*filelist, error) {
 
-	flag.StringVar(&domain, "domain", "", "Domain of Duet Wifi")
-	flag.Uint64Var(&port, "port", 80, "Port of Duet Wifi")
-	flag.StringVar(&dirToBackup, "dirToBackup", sysDir, "Directory on Duet to create a backup of")
-	flag.StringVar(&outDir, "outDir", "", "Output dir of backup")
-	flag.StringVar(&password, "password", "reprap", "Connection password")
-	flag.BoolVar(&removeLocal, "removeLocal", false, "Remove files locally that have been deleted on the Duet")
-	flag.BoolVar(&verbose, "verbose", false, "Output more details")
-	flag.Var(&excls, "exclude", "Exclude paths starting with this string (can be passed multiple times)")
-	flag.Parse()
+	// Skip complete directories if they are covered by an exclude pattern
+	// or an ignore file
+	if o.excls.Contains(folder) || o.ignored(folder) {
+		o.info("Excluding", folder)
+		return nil, nil
+	}
 
-	if domain == "" || outDir == "" {
-		log.Fatal("-domain and -outDir are mandatory parameters")
+	// Skip directories completely handled by an interrupted previous run
+	if o.j.Contains(dirEntry(folder)) {
+		o.info("Skipping already completed", folder)
+		return nil, nil
 	}
 
-	if port > 65535 {
-		log.Fatal("Invalid port", port)
+	o.info("Fetching filelist for", folder)
+	fl, err := getFileList(address, folder, 0, o)
+	if err != nil {
+		return nil, o.fail(folder, err)
 	}
 
-	tr := &http.Transport{DisableCompression: true}
-	httpClient = &http.Client{Transport: tr}
+	// A directory that suddenly appears empty might be a hiccup of the
+	// firmware so make sure before removing all local files
+	if o.removeLocal && len(fl.Files) == 0 && o.m.hasFilesIn(folder) && hasLocalFiles(outDir) {
+		log.Println("  Listing of", folder, "is empty although it contained files before, requesting it again")
+		o.cache.Delete(folder)
+		if fl, err = getFileList(address, folder, 0, o); err != nil {
+			return nil, o.fail(folder, err)
+		}
+		if len(fl.Files) == 0 {
+			log.Println("  Confirmed that", folder, "is empty")
+		}
+	}
+	if o.recordListings {
+		o.listings = append(o.listings, fl)
+	}
 
-	address := getAddress(domain, port)
+	// Skip huge directories like print jobs that were not asked for
+	if o.maxFilesPerDir > 0 && folder != o.dirToBackup && !o.allowLarge.Contains(folder) {
+		if n := countFiles(fl); n > o.maxFilesPerDir {
+			log.Println("  Skipping", folder, "since it contains", n, "files, use -allowLarge to back it up")
+			return nil, nil
+		}
+	}
 
-	// Try to connect
-	if err := connect(address, password, verbose); err != nil {
-		log.Println("Duet currently not available")
-		os.Exit(0)
+	// Do not back up backups made by duetbackup that the Duet serves
+	for _, f := range fl.Files {
+		if f.Type != typeDirectory && f.Name == dirMarker {
+			log.Println("  Skipping", folder, "since it contains a backup made by duetbackup")
+			return nil, nil
+		}
 	}
 
-	// Get absolute path from user's input
-	absPath, err := filepath.Abs(outDir)
+	// Apply an ignore file to this directory and everything below it
+	if err = loadIgnoreFile(address, fl, o); err != nil {
+		return nil, o.fail(folder+"/"+ignoreFileName, err)
+	}
+
+	// Remote directory used to be a file so remove it
+	fi, err := os.Stat(outDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if fi != nil && !fi.IsDir() {
+		log.Println("  Replacing file", outDir, "by directory")
+		if err = os.Remove(outDir); err != nil {
+			return nil, err
+		}
+	}
+	return fl, nil
+}
+
+// syncFiles downloads the files of a single listing into outDir and
+// afterwards removes local files that no longer exist on the Duet
+func syncFiles(address string, fl *filelist, outDir string, o *options) error {
+	o.info("Downloading new/changed files from", fl.Dir, "to", outDir)
+	if err := updateLocalFiles(address, fl, outDir, o); err != nil {
+		return err
+	}
+
+	// Only now that all downloads into outDir are done
+	if o.removeLocal {
+		o.info("Removing no longer existing files in", outDir)
+		if err := removeDeletedFiles(fl, outDir, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abbreviate returns at most max bytes of body followed by an ellipsis
+// if it had to be shortened
+func abbreviate(body []byte, max int) string {
+	if len(body) <= max {
+		return string(body)
+	}
+	return string(body[:max]) + "..."
+}
+
+// warnIfLargerThanFree warns if the backup is larger than the free space
+// on the Duet's volume. This usually means that a different volume is
+// mounted below dirToBackup or a link creates a loop.
+func warnIfLargerThanFree(address, dirToBackup string, o *options) {
+	volume := 0
+	if i := strings.Index(dirToBackup, ":"); i > 0 {
+		volume, _ = strconv.Atoi(dirToBackup[:i])
+	}
+	free, err := volumeFreeSpace(address, volume, o.listTimeout)
 	if err != nil {
-		// Fall back to original user's input
-		absPath = outDir
+		if o.verbose {
+			log.Println("Could not determine free space on the Duet:", err)
+		}
+		return
 	}
+	if o.stats.remoteBytes > free {
+		log.Printf("WARNING: the backup of %s is %d bytes but only %d bytes are free on the Duet, check that dirToBackup is what you expect", dirToBackup, o.stats.remoteBytes, free)
+	}
+}
 
-	if err = syncFolder(address, cleanPath(dirToBackup), absPath, excls, removeLocal, verbose); err != nil {
-		log.Fatal(err)
+// exitCodesHelp is appended to the usage message
+const exitCodesHelp = `
+Exit codes:
+  0  success
+  1  some files could not be backed up, the backup is not current, the run failed or another instance holds the lock
+  2  the Duet rejected the password
+  3  the Duet could not be reached
+  4  invalid flags or settings
+`
+
+// usage prints the default usage message followed by the exit codes
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprint(flag.CommandLine.Output(), exitCodesHelp)
+}
+
+// exitHooks are run by exit before the process terminates since
+// deferred calls are skipped by os.Exit
+var exitHooks []func()
+
+// exit runs the exit hooks in reverse order and terminates with code
+func exit(code int) {
+	for i := len(exitHooks) - 1; i >= 0; i-- {
+		exitHooks[i]()
+	}
+	os.Exit(code)
+}
+
+// fatal works like log.Fatal but runs the exit hooks
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	exit(1)
+}
+
+// fatalConfig logs the message and exits with exitConfig
+func fatalConfig(v ...interface{}) {
+	log.Print(v...)
+	exit(exitConfig)
+}
+
+// flagSet reports whether the flag was given explicitly
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// setupLogFile makes the standard logger write to the given file
+// in addition to stderr
+func setupLogFile(path string, appendToFile bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendToFile {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	if err := ensureParentDirs(path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, f))
+	return nil
+}
+
+func getAddress(domain string, port uint64) string {
+	return "http://" + net.JoinHostPort(domain, strconv.FormatUint(port, 10))
+}
+
+// splitDomain separates a port given as part of the domain, e.g.
+// duet.lan:8080 or [fe80::1]:8080. Bare IPv6 addresses with or without
+// brackets are returned as host without a port.
+func splitDomain(domain string) (host string, port uint64, hasPort bool, err error) {
+	if !strings.HasPrefix(domain, "[") && strings.Count(domain, ":") != 1 {
+		return domain, 0, false, nil
+	}
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		return domain[1 : len(domain)-1], 0, false, nil
+	}
+	host, p, err := net.SplitHostPort(domain)
+	if err != nil {
+		return "", 0, false, err
+	}
+	port, err = strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("invalid port in %s", domain)
+	}
+	return host, port, true, nil
+}
+
+// hashPassword turns the password into the token expected by firmware
+// that does not accept the plain password. The token is the lower-case
+// hex encoding of the MD5 or SHA-256 digest of the UTF-8 password.
+func hashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case "", "none":
+		return password, nil
+	case "md5":
+		sum := md5.Sum([]byte(password))
+		return hex.EncodeToString(sum[:]), nil
+	case "sha256":
+		sum := sha256.Sum256([]byte(password))
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("unknown password hash %s", algorithm)
+}
+
+func connect(address, password string, verbose bool) error {
+	if verbose {
+		log.Println("Trying to connect to Duet")
+	}
+	if apiMode == apiREST {
+		return restConnect(address, password)
+	}
+	path := "/rr_connect?password=" + url.QueryEscape(password) + "&time=" + url.QueryEscape(time.Now().Format("2006-01-02T15:04:05"))
+	resp, err := httpClient.Get(address + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("connect failed: " + resp.Status)
+	}
+
+	// RepRapFirmware reports the result in the err field
+	var result struct {
+		Err int `json:"err"`
+	}
+	if err = json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("invalid connect response %q: %s", abbreviate(body, maxErrorBody), err)
+	}
+	switch result.Err {
+	case 0:
+		return nil
+	case 1:
+		return errWrongPassword
+	case 2:
+		return errTooManySessions
+	default:
+		return fmt.Errorf("connect failed with error code %d", result.Err)
+	}
+}
+
+// connectSession connects to the Duet and waits for a free session if
+// all of them are taken, e.g. by an overlapping run. Before each retry
+// a possibly stale session of this host is released.
+func connectSession(address, password string, o *options) error {
+	err := connect(address, password, o.verbose)
+	for attempt := 1; err == errTooManySessions && attempt <= sessionRetries; attempt++ {
+		o.info("No free session on the Duet, retrying in", sessionRetryDelay, "("+strconv.Itoa(attempt)+"/"+strconv.Itoa(sessionRetries)+")")
+		if derr := disconnect(address); derr != nil && o.verbose {
+			log.Println("Failed to release session:", derr)
+		}
+		time.Sleep(sessionRetryDelay)
+		err = connect(address, password, o.verbose)
+	}
+	return err
+}
+
+// disconnect releases the session of this host on the Duet
+func disconnect(address string) error {
+	resp, err := httpClient.Get(address + "/rr_disconnect")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("disconnect failed: " + resp.Status)
+	}
+	return nil
+}
+
+func main() {
+	var domain, dirToBackup, outDir, password string
+	var port uint64
+	var maxIdleConns, maxConnsPerHost, noChangeExitCode, connectRetries, minFiles int
+	var waitLock, downloadDeadline, waitIdleFor time.Duration
+	var maxRequestsPerSec float64
+	var incremental, logAppend bool
+	var logFile, diffAgainst, textExtensions, metricsFile, journalFile, renameMapFile, fileList string
+	var owner, group, prefix, timingFile, listingFile, bundleFile, changelogFile, getPath, exportFile, debugHTTPDir, trimPrefix string
+	var normalize, discoverDuet, check, list, listJSON, preserveDrive, verifyOnly, printConf, plugins, assertCurrent, skipActive, restore, dryRun, refreshListing, verifyLocal, requireIdle, ignoreCase, checkClockSkew, onlyIfChanged, gitMode, gitPush, debugHTTP, assumeYes bool
+	var discoverName, userAgent, passwordHash string
+	var discoverTimeout, cacheListing time.Duration
+	var o options
+
+	flag.StringVar(&domain, "domain", "", "Domain of Duet Wifi, optionally including the port like duet.lan:8080 or [fe80::1]:8080 which takes precedence over -port")
+	flag.Uint64Var(&port, "port", 80, "Port of Duet Wifi")
+	flag.StringVar(&dirToBackup, "dirToBackup", sysDir, "Directory on Duet to create a backup of")
+	flag.StringVar(&outDir, "outDir", "", "Output dir of backup")
+	flag.StringVar(&prefix, "prefix", "", "Subdirectory of outDir to store the backup in, e.g. the name of the printer")
+	flag.StringVar(&password, "password", defaultPassword, "Connection password")
+	flag.StringVar(&passwordHash, "passwordHash", "none", "Send the hex encoded md5 or sha256 digest of the password instead of the password itself (none, md5, sha256)")
+	flag.BoolVar(&assumeYes, "yes", false, "Do not ask before -removeLocal removes files from an outDir that is not empty but was never backed up to")
+	flag.BoolVar(&o.removeLocal, "removeLocal", false, "Remove files locally that have been deleted on the Duet")
+	flag.Var(&o.keepLocal, "keepLocal", "With -removeLocal never remove local files or directories matching this glob pattern; patterns with a slash match the path relative to outDir (can be passed multiple times)")
+	flag.Var(&o.readOnly, "readOnlyPattern", "Make downloaded files matching this glob pattern read-only; patterns with a slash match the path relative to outDir (can be passed multiple times)")
+	flag.StringVar(&o.rateUnit, "rateUnit", rateUnitKiB, "Unit of the transfer rates shown with -verbose: "+rateUnitKiB+", "+rateUnitMiB+" or "+rateUnitAuto+" to choose by magnitude")
+	flag.IntVar(&o.rateDecimals, "rateDecimals", 1, "Number of decimal places of the transfer rates shown with -verbose")
+	flag.BoolVar(&o.verbose, "verbose", false, "Output more details")
+	flag.BoolVar(&o.quiet, "quiet", false, "Only output warnings and errors")
+	flag.Var(&o.excls, "exclude", "Exclude paths starting with this string; prefix with ./ to make it relative to dirToBackup; separate multiple excludes by commas and escape commas and backslashes within them as \\, and \\\\ (can be passed multiple times)")
+	flag.Var(&o.redact, "redactPattern", "Replace lines matching this regular expression by a placeholder, e.g. to keep WiFi passwords out of the backup; such files cannot be restored as is (can be passed multiple times)")
+	flag.Var(regexExcludes{&o.excls}, "excludeRegex", "Exclude paths matching this regular expression (can be passed multiple times)")
+	flag.BoolVar(&ignoreCase, "ignoreCase", false, "Match -exclude, -excludeRegex and -allowLarge regardless of case")
+	flag.DurationVar(&waitLock, "waitLock", 0, "How long to wait for another instance working on outDir to finish before giving up")
+	flag.BoolVar(&o.showHidden, "showHidden", false, "Also list hidden/system files if the firmware supports it")
+	flag.BoolVar(&onlyIfChanged, "onlyIfChanged", false, "Skip the run with -noChangeExitCode if the Duet reports that no file changed since the last successful run (requires firmware reporting seqs.volChanges, otherwise a normal run is done)")
+	flag.BoolVar(&incremental, "incremental", false, "Only consider files modified since the last successful run (files deleted locally will not be restored)")
+	flag.StringVar(&logFile, "logFile", "", "Also write log output to this file")
+	flag.BoolVar(&logAppend, "logAppend", false, "Append to -logFile instead of truncating it")
+	flag.StringVar(&diffAgainst, "diffAgainst", "", "Previous backup directory to compare against; writes "+changesFile+" to outDir")
+	flag.BoolVar(&normalize, "normalizeLineEndings", false, "Convert CRLF line endings of text files to LF (recorded in the manifest)")
+	flag.StringVar(&textExtensions, "textExtensions", ".g,.csv,.json,.txt", "Comma-separated list of extensions treated as text files")
+	flag.StringVar(&metricsFile, "metricsFile", "", "Write metrics in Prometheus text format to this file after each run")
+	flag.BoolVar(&gitMode, "git", false, "Commit all changes in outDir, which has to be part of a git repository, after a successful run that transferred or removed files")
+	flag.BoolVar(&gitPush, "gitPush", false, "With -git push the commit to the default remote")
+	flag.StringVar(&changelogFile, "changelog", "", "Append a one-line summary of each run to this file")
+	flag.BoolVar(&discoverDuet, "discover", false, "Find the Duet via mDNS (falls back to -domain and -port if nothing is found)")
+	flag.StringVar(&discoverName, "discoverName", "duet", "Part of the mDNS service name identifying the Duet")
+	flag.DurationVar(&discoverTimeout, "discoverTimeout", 3*time.Second, "How long to wait for mDNS responses")
+	flag.BoolVar(&debugHTTP, "debugHTTP", false, "Log every HTTP request with the status and size of its response (passwords are masked)")
+	flag.StringVar(&debugHTTPDir, "debugHTTPDir", "", "With -debugHTTP also write every response body to a numbered file in this directory")
+	flag.StringVar(&userAgent, "userAgent", "duetbackup/"+version, "User-Agent header sent with every request")
+	flag.BoolVar(&printConf, "printConfig", false, "Print the effective configuration from command-line and "+optsEnv+" before running and exit if combined with -dryRun")
+	flag.BoolVar(&checkClockSkew, "checkClock", false, "After connecting read the time of the Duet back and warn if its clock is not in sync with this host")
+	flag.BoolVar(&check, "check", false, "Only check connectivity and permissions and print a report")
+	flag.IntVar(&retries.perRequest, "retries", 0, "Number of times a failed request is retried")
+	flag.IntVar(&retries.budget, "maxTotalRetries", -1, "Maximum number of retries for the whole run (-1 means no limit)")
+	flag.StringVar(&apiMode, "api", apiRR, "API used to talk to the Duet: "+apiRR+" for standalone boards or "+apiREST+" for a Duet 3 with SBC")
+	flag.BoolVar(&o.validateConfig, "validateConfig", false, "Warn about downloaded .g files that look truncated or corrupt, e.g. with unbalanced quotes or a size different from the one reported by the Duet")
+	flag.StringVar(&o.order, "order", orderDepthFirst, "Order of traversal: "+orderDepthFirst+" handles the files of a directory before its subdirectories, "+orderFilesLast+" after them and "+orderBreadthFirst+" handles all directories of one level before the next")
+	flag.DurationVar(&cacheListing, "cacheListing", 0, "Reuse directory listings of a previous run that are not older than this (0 disables caching)")
+	flag.BoolVar(&refreshListing, "refreshListing", false, "With -cacheListing ignore cached listings and fetch them again")
+	flag.StringVar(&listingFile, "saveListing", "", "Write the listings of all visited directories as JSON to this file")
+	flag.StringVar(&timingFile, "timing", "", "Write path, bytes, duration and rate of every download as CSV to this file")
+	flag.StringVar(&journalFile, "journal", "", "Record completed paths in this file to skip them when resuming an interrupted run")
+	flag.BoolVar(&o.storeXattrs, "storeXattrs", false, "Store size and date reported by the Duet as extended attributes user.duet.size and user.duet.mtime (Linux only)")
+	flag.BoolVar(&o.storeCompressed, "storeCompressed", false, "Store files gzipped with an additional "+compressedSuffix+" suffix")
+	flag.BoolVar(&o.decompressGz, "decompressGz", false, "Store remote files ending in "+compressedSuffix+" decompressed without that suffix (recorded in the manifest and compressed again by -restore)")
+	flag.StringVar(&renameMapFile, "renameMap", "", "File with remotePrefix=localPrefix rules (one per line) to store remote paths elsewhere below outDir")
+	flag.IntVar(&noChangeExitCode, "noChangeExitCode", 0, "Exit code to use if the run neither transferred nor removed any file")
+	flag.DurationVar(&o.deleteAfter, "deleteAfter", 0, "With -removeLocal only remove local files after they have been missing on the Duet for this long")
+	flag.BoolVar(&list, "list", false, "Only list the remote files of dirToBackup")
+	flag.BoolVar(&listJSON, "listJson", false, "Only list the remote files of dirToBackup as nested JSON")
+	flag.StringVar(&trimPrefix, "trimPrefix", "", "Store files below outDir with the path of dirToBackup after removing this prefix, e.g. -dirToBackup 0:/sys/firmware -trimPrefix 0:/sys stores them in outDir/firmware")
+	flag.BoolVar(&preserveDrive, "preserveDrive", false, "Store files below outDir including drive and full path of dirToBackup, e.g. outDir/0/sys")
+	flag.DurationVar(&downloadDeadline, "downloadDeadline", 0, "Do not start new downloads after the run took this long; skipped files cause exit code 1")
+	flag.StringVar(&owner, "owner", "", "Change the owner of created files and directories to this user name or ID (not on Windows)")
+	flag.StringVar(&group, "group", "", "Change the group of created files and directories to this group name or ID (not on Windows)")
+	flag.BoolVar(&o.owner.strict, "strictOwnership", false, "Abort if the owner or group cannot be changed instead of only warning")
+	flag.IntVar(&o.maxFilesPerDir, "maxFilesPerDir", 0, "Skip directories below dirToBackup containing more files than this unless covered by -allowLarge (0 means no limit)")
+	flag.IntVar(&minFiles, "minFiles", 0, "Fail the run with exit code 1 if fewer files than this were backed up, e.g. because a listing was incomplete (0 disables the check)")
+	flag.Var(&o.allowLarge, "allowLarge", "Back up directories starting with this path regardless of -maxFilesPerDir; prefix with ./ to make it relative to dirToBackup (can be passed multiple times)")
+	flag.DurationVar(&o.minAge, "minAge", 0, "Do not download files modified more recently than this to not get files that are still being written (exit code 1 as they are skipped)")
+	flag.BoolVar(&skipActive, "skipActive", false, "Do not download the file that is currently being printed (exit code 1 as it is skipped)")
+	flag.BoolVar(&o.continueOnError, "continueOnError", false, "Continue with the remaining files if a file or directory cannot be backed up and report all errors at the end (exit code 1)")
+	flag.BoolVar(&plugins, "plugins", false, "Back up the files of all installed plugins instead of dirToBackup (regeneratable files like source maps are excluded)")
+	flag.StringVar(&fileList, "fileList", "", "Download only the remote files listed one per line in this file instead of listing dirToBackup (for firmware without directory listing)")
+	flag.StringVar(&getPath, "get", "", "Only download this single remote file, e.g. 0:/sys/config.g, to outDir or to stdout if -outDir is not given")
+	flag.StringVar(&exportFile, "export", "", "Only write all files of dirToBackup with their metadata and base64 encoded content as a single JSON document to this file")
+	flag.StringVar(&bundleFile, "bundle", "", "Only write config.g, config-override.g, heightmap.csv, all macros and the object model together with a manifest into this zip file")
+	flag.BoolVar(&requireIdle, "requireIdle", false, "Skip the run with -noChangeExitCode if the Duet is printing, simulating or paused")
+	flag.DurationVar(&waitIdleFor, "waitIdle", 0, "Like -requireIdle but first wait up to this long for the print to finish")
+	flag.BoolVar(&restore, "restore", false, "Upload the backup in outDir to dirToBackup on the Duet instead of creating a backup keeping the modification times if supported (files with redacted lines are skipped)")
+	flag.BoolVar(&dryRun, "dryRun", false, "With -restore only print which files would be created or changed on the Duet without uploading anything")
+	flag.BoolVar(&verifyLocal, "verifyLocal", false, "Only hash the local files and compare them against the manifest to find corrupted files (exit code 1 if any is found); does not contact the Duet")
+	flag.BoolVar(&verifyOnly, "verifyOnly", false, "Only compare the local backup against the remote listing and report differences")
+	flag.IntVar(&connectRetries, "connectRetries", 0, "Number of additional connection attempts before the Duet is considered unavailable")
+	flag.BoolVar(&assertCurrent, "assertCurrent", false, "Like -verifyOnly but exit with code 1 if a run would add, update or (with -removeLocal) remove files")
+	flag.BoolVar(&o.deepVerify, "deepVerify", false, "Also download up-to-date files and compare them against the hash stored in the manifest")
+	flag.IntVar(&o.pageSize, "pageSize", 0, "Number of entries to request per directory listing page if the firmware supports it; more pages are requested if it returns fewer (0 uses the firmware default)")
+	flag.BoolVar(&o.resume, "resume", false, "Keep incomplete downloads of files larger than -streamThreshold and continue them on the next attempt if the file did not change (not with -storeCompressed)")
+	flag.Uint64Var(&o.streamThreshold, "streamThreshold", defaultStreamThreshold, "Size in bytes above which files are written to disk while downloading instead of being buffered in memory (0 streams all files that allow it)")
+	flag.DurationVar(&o.listTimeout, "listTimeout", 0, "Abort a directory listing request after this duration (0 means no timeout)")
+	flag.DurationVar(&o.downloadTimeout, "downloadTimeout", 0, "Abort a file download request after this duration (0 means no timeout)")
+	flag.Float64Var(&o.minRate, "minRate", 0, "Abort a file download that is slower than this many KiB/s by using a timeout of baseTimeout plus the size divided by minRate instead of -downloadTimeout (0 disables it)")
+	flag.DurationVar(&o.baseTimeout, "baseTimeout", 10*time.Second, "Part of the download timeout independent of the file size when using -minRate")
+	flag.Float64Var(&maxRequestsPerSec, "maxRequestsPerSec", 0, "Maximum number of listing and download requests per second (0 means no limit)")
+	flag.IntVar(&maxIdleConns, "maxIdleConns", http.DefaultMaxIdleConnsPerHost, "Maximum number of idle connections kept open to the Duet")
+	flag.IntVar(&maxConnsPerHost, "maxConnsPerHost", 0, "Maximum number of simultaneous connections to the Duet (0 means no limit)")
+
+	// Flags from the environment come first so the command-line overrides them
+	args, err := argsWithEnv()
+	if err != nil {
+		fatalConfig(err)
+	}
+	os.Args = args
+	flag.Usage = usage
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err = flag.CommandLine.Parse(os.Args[1:]); err == flag.ErrHelp {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(exitConfig)
+	}
+
+	if logFile != "" {
+		if err := setupLogFile(logFile, logAppend); err != nil {
+			fatalConfig(err)
+		}
+	}
+
+	if discoverDuet {
+		host, discoveredPort, err := discover(discoverName, discoverTimeout)
+		if err == nil {
+			o.info("Discovered Duet at", host, "port", discoveredPort)
+			domain, port = host, discoveredPort
+		} else if domain != "" {
+			log.Println("Discovery failed, falling back to", domain+":", err)
+		} else {
+			log.Println("Discovery failed:", err)
+			os.Exit(exitUnreachable)
+		}
+	}
+
+	if (domain == "" && !verifyLocal) || (outDir == "" && !list && !listJSON && bundleFile == "" && getPath == "" && exportFile == "") {
+		fatalConfig("-domain and -outDir are mandatory parameters")
+	}
+
+	if o.verbose && o.quiet {
+		fatalConfig("-verbose and -quiet are mutually exclusive")
+	}
+	if fileList != "" && o.removeLocal {
+		fatalConfig("-fileList and -removeLocal are mutually exclusive")
+	}
+	if gitPush && !gitMode {
+		fatalConfig("-gitPush requires -git")
+	}
+	if o.storeCompressed && o.decompressGz {
+		fatalConfig("-storeCompressed and -decompressGz are mutually exclusive")
+	}
+	if dryRun && !restore {
+		fatalConfig("-dryRun requires -restore")
+	}
+	if restore {
+		if _, err := os.Stat(outDir); err != nil {
+			fatalConfig("Cannot restore: ", err)
+		}
+	}
+	if plugins {
+		if fileList != "" || o.removeLocal || list || listJSON || verifyOnly || assertCurrent {
+			fatalConfig("-plugins cannot be combined with -fileList, -removeLocal, -list, -listJson, -verifyOnly or -assertCurrent")
+		}
+		dirToBackup = sdRoot
+		o.excls.regexes = append(o.excls.regexes, pluginExcludes...)
+	}
+
+	if prefix != "" {
+		clean := filepath.Clean(prefix)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			fatalConfig("-prefix must be a relative path below outDir")
+		}
+		outDir = filepath.Join(outDir, prefix)
+	}
+
+	if host, domainPort, hasPort, err := splitDomain(domain); err != nil {
+		fatalConfig("Invalid domain: ", err)
+	} else if hasPort {
+		if flagSet("port") && port != domainPort {
+			log.Println("Using port", domainPort, "from -domain instead of -port", port)
+		}
+		domain, port = host, domainPort
+	} else {
+		domain = host
+	}
+	if port > 65535 {
+		fatalConfig("Invalid port ", port)
+	}
+
+	dirToBackup = cleanPath(dirToBackup)
+	if trimPrefix != "" {
+		trimPrefix = cleanPath(trimPrefix)
+		if preserveDrive {
+			fatalConfig("-trimPrefix and -preserveDrive are mutually exclusive")
+		}
+		if dirToBackup != trimPrefix && !strings.HasPrefix(dirToBackup, trimPrefix+"/") {
+			fatalConfig("-dirToBackup ", dirToBackup, " does not start with -trimPrefix ", trimPrefix)
+		}
+	}
+	o.excls.ResolveRelative(dirToBackup)
+	o.allowLarge.ResolveRelative(dirToBackup)
+	o.dirToBackup = dirToBackup
+	if ignoreCase {
+		o.excls.IgnoreCase()
+		o.allowLarge.IgnoreCase()
+	}
+
+	if apiMode != apiRR && apiMode != apiREST {
+		fatalConfig("Invalid API ", apiMode)
+	}
+	if o.rateUnit != rateUnitAuto && o.rateUnit != rateUnitKiB && o.rateUnit != rateUnitMiB {
+		fatalConfig("Invalid rate unit ", o.rateUnit)
+	}
+	if o.rateDecimals < 0 {
+		fatalConfig("-rateDecimals must not be negative")
+	}
+	if o.order != orderDepthFirst && o.order != orderBreadthFirst && o.order != orderFilesLast {
+		fatalConfig("Invalid order ", o.order)
+	}
+
+	if apiMode == apiREST && o.showHidden {
+		log.Println("-showHidden is not supported with -api", apiREST)
+		o.showHidden = false
+	}
+
+	if o.storeXattrs && !xattrsSupported {
+		log.Println("-storeXattrs is not supported on this platform, no extended attributes will be stored")
+		o.storeXattrs = false
+	}
+
+	usePassword := password != defaultPassword
+	password, err = hashPassword(password, passwordHash)
+	if err != nil {
+		fatalConfig(err)
+	}
+
+	if o.owner.uid, err = resolveUser(owner); err != nil {
+		fatalConfig(err)
+	}
+	if o.owner.gid, err = resolveGroup(group); err != nil {
+		fatalConfig(err)
+	}
+	if !ownershipSupported && (o.owner.uid >= 0 || o.owner.gid >= 0) {
+		log.Println("-owner and -group are not supported on this platform")
+		o.owner = ownership{uid: -1, gid: -1}
+	}
+
+	if o.pageSize < 0 {
+		fatalConfig("-pageSize must not be negative")
+	}
+
+	if o.maxFilesPerDir < 0 {
+		fatalConfig("-maxFilesPerDir must not be negative")
+	}
+	if minFiles < 0 {
+		fatalConfig("-minFiles must not be negative")
+	}
+	if o.minAge < 0 {
+		fatalConfig("-minAge must not be negative")
+	}
+	if o.minRate < 0 || o.baseTimeout < 0 {
+		fatalConfig("-minRate and -baseTimeout must not be negative")
+	}
+
+	if maxRequestsPerSec < 0 {
+		fatalConfig("-maxRequestsPerSec must not be negative")
+	} else if maxRequestsPerSec > 0 {
+		requestLimiter = newRateLimiter(maxRequestsPerSec)
+	}
+
+	if maxIdleConns < 0 || maxConnsPerHost < 0 {
+		fatalConfig("-maxIdleConns and -maxConnsPerHost must not be negative")
+	}
+
+	// Keep connections alive so not every request has to set up a new one
+	var tr http.RoundTripper = &http.Transport{
+		DisableCompression:  true,
+		IdleConnTimeout:     idleConnTimeout,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		MaxConnsPerHost:     maxConnsPerHost,
+	}
+	if debugHTTP {
+		if debugHTTPDir != "" {
+			if err = os.MkdirAll(debugHTTPDir, 0755); err != nil {
+				fatalConfig(err)
+			}
+		}
+		tr = &debugTransport{next: tr, dumpDir: debugHTTPDir}
+	} else if debugHTTPDir != "" {
+		fatalConfig("-debugHTTPDir requires -debugHTTP")
+	}
+	var reuse *reuseCountingTransport
+	if o.verbose {
+		reuse = &reuseCountingTransport{next: tr}
+		tr = reuse
+	}
+	header := make(http.Header)
+	header.Set("User-Agent", userAgent)
+	httpClient = &http.Client{Transport: &headerTransport{header: header, next: tr}}
+
+	address := getAddress(domain, port)
+
+	// Get absolute path from user's input
+	absPath, err := filepath.Abs(outDir)
+	if err != nil {
+		// Fall back to original user's input
+		absPath = outDir
+	}
+
+	if renameMapFile != "" {
+		if o.renames, err = loadRenameMap(renameMapFile); err != nil {
+			fatalConfig(err)
+		}
+	}
+	o.outRoot = absPath
+	if outDir != "" && !restore {
+		if err = checkSelfInclusion(dirToBackup, absPath); err != nil {
+			fatalConfig(err)
+		}
+	}
+
+	// Print the configuration before anything is done with it and stop
+	// there if nothing would be changed anyway
+	if printConf {
+		printConfig(os.Stdout, flag.CommandLine, &o.excls)
+		if dryRun {
+			os.Exit(0)
+		}
+	}
+
+	// Never remove our own output files if they are placed inside outDir
+	o.protect(logFile)
+	o.protect(metricsFile)
+	o.protect(changelogFile)
+	o.protect(journalFile)
+	o.protect(timingFile)
+	o.protect(listingFile)
+	o.recordListings = listingFile != ""
+
+	rootDir := absPath
+	if preserveDrive {
+		rootDir = filepath.Join(absPath, drivePath(dirToBackup))
+	} else if trimPrefix != "" {
+		rootDir = filepath.Join(absPath, filepath.FromSlash(strings.TrimPrefix(dirToBackup, trimPrefix)))
+	}
+	rootDir = o.localPath(dirToBackup, rootDir)
+
+	// Arguments needed to restore this backup later on
+	restoreArgs := []string{"-restore", "-domain", domain, "-port", strconv.FormatUint(port, 10), "-dirToBackup", dirToBackup, "-outDir", absPath, "-api", apiMode}
+	if preserveDrive {
+		restoreArgs = append(restoreArgs, "-preserveDrive")
+	}
+	if trimPrefix != "" {
+		restoreArgs = append(restoreArgs, "-trimPrefix", trimPrefix)
+	}
+	if renameMapFile != "" {
+		if abs, err := filepath.Abs(renameMapFile); err == nil {
+			renameMapFile = abs
+		}
+		restoreArgs = append(restoreArgs, "-renameMap", renameMapFile)
+	}
+	if passwordHash != "none" {
+		restoreArgs = append(restoreArgs, "-passwordHash", passwordHash)
+	}
+
+	if check {
+		if !runChecks(address, password, dirToBackup, absPath, &o, metricsFile, journalFile, timingFile, listingFile, changelogFile) {
+			os.Exit(exitPartial)
+		}
+		return
+	}
+
+	if verifyLocal {
+		if o.m, err = loadManifest(absPath); err != nil {
+			log.Fatal(err)
+		}
+		var res verifyResult
+		if err = verifyLocalHashes(os.Stdout, dirToBackup, rootDir, &o, &res); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d files intact, %d corrupt, %d without hash\n", res.ok, res.mismatched, res.unhashed)
+		if res.mismatched > 0 {
+			os.Exit(exitDrift)
+		}
+		return
+	}
+
+	if cacheListing > 0 {
+		o.cache = openListingCache(listingCachePath(address, o.showHidden), cacheListing, refreshListing)
+	}
+
+	// Try to connect
+	err = connectSession(address, password, &o)
+	for attempt := 1; err != nil && err != errWrongPassword && attempt <= connectRetries; attempt++ {
+		o.info("Connection failed, retrying in", connectRetryDelay, "("+strconv.Itoa(attempt)+"/"+strconv.Itoa(connectRetries)+")")
+		time.Sleep(connectRetryDelay)
+		err = connectSession(address, password, &o)
+	}
+	if err == errWrongPassword {
+		log.Println(err)
+		os.Exit(exitAuth)
+	} else if err != nil {
+		log.Println("Duet currently not available:", err)
+		os.Exit(exitUnreachable)
+	}
+
+	// Release the session on the Duet on every way out
+	release := func() {
+		if err := disconnect(address); err != nil && o.verbose {
+			log.Println("Failed to release session:", err)
+		}
+	}
+	exitHooks = append(exitHooks, release)
+	defer release()
+
+	if checkClockSkew {
+		checkClock(address, &o)
+	}
+
+	if getPath != "" {
+		fileName, err := getFile(address, cleanPath(getPath), outDir, &o)
+		if err != nil {
+			fatal(err)
+		}
+		if fileName != "" {
+			o.info("Downloaded", getPath, "to", fileName)
+		}
+		return
+	}
+
+	if exportFile != "" {
+		if err = writeExport(address, dirToBackup, exportFile, &o); err != nil {
+			fatal(err)
+		}
+		o.info("Exported", o.stats.added, "files to", exportFile)
+		return
+	}
+
+	if bundleFile != "" {
+		if err = writeBundle(address, bundleFile, &o); err != nil {
+			fatal(err)
+		}
+		o.info("Wrote bundle", bundleFile)
+		return
+	}
+
+	if list || listJSON {
+		fl, err := listTree(address, dirToBackup, &o)
+		if err != nil {
+			fatal(err)
+		}
+		saveCache(o.cache)
+		if listJSON {
+			err = writeTreeJSON(os.Stdout, fl)
+		} else {
+			printTree(os.Stdout, fl, &o)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if verifyOnly || assertCurrent {
+		if o.m, err = loadManifest(absPath); err != nil {
+			fatal(err)
+		}
+		fl, err := listTree(address, dirToBackup, &o)
+		if err != nil {
+			fatal(err)
+		}
+		saveCache(o.cache)
+		var res verifyResult
+		if err = verifyTree(os.Stdout, fl, rootDir, &o, &res); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%d files up-to-date, %d missing, %d different, %d extra, %d differing only in size\n", res.ok, res.missing, res.mismatched, res.extra, res.sizeOnly)
+		if assertCurrent && !res.valid(o.removeLocal) {
+			log.Println("Backup is not current")
+			exit(exitDrift)
+		}
+		return
+	}
+
+	if requireIdle || waitIdleFor > 0 {
+		status, busy, err := waitIdle(address, waitIdleFor, &o)
+		if err != nil {
+			fatal("Failed to query the machine status: ", err)
+		}
+		if busy {
+			o.info("Skipping backup: Duet is", status)
+			exit(noChangeExitCode)
+		}
+	}
+
+	// Guard against removing files from the wrong directory
+	if o.removeLocal && !assumeYes && needsRemoveConfirmation(absPath) {
+		if !isTerminal(os.Stdin) {
+			fatalConfig(absPath, " is not empty and contains no previous backup, pass -yes to let -removeLocal remove files from it")
+		}
+		if !confirm(absPath + " is not empty and contains no previous backup. Remove local files that do not exist on the Duet?") {
+			log.Println("Aborted")
+			exit(exitPartial)
+		}
+	}
+
+	// Create all directories up front so a run does not fail after
+	// transferring everything
+	if err = ensureOutDirExists(absPath, &o); err != nil {
+		fatal(err)
+	}
+	if err = ensureParentDirs(metricsFile, journalFile, timingFile, listingFile, changelogFile); err != nil {
+		fatal(err)
+	}
+
+	if gitMode {
+		if err = checkGitRepository(absPath); err != nil {
+			fatal(err)
+		}
+		o.protect(filepath.Join(absPath, ".git"))
+	}
+
+	// Make sure we are the only instance working on this directory
+	l, err := acquireLock(absPath, waitLock)
+	if err == errLocked {
+		log.Println("Skipping backup:", err)
+		exit(exitPartial)
+	} else if err != nil {
+		fatal(err)
+	}
+
+	// Release the lock also when we get interrupted
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		l.release()
+		fatal("Received ", sig, ", aborting")
+	}()
+
+	m, err := loadManifest(absPath)
+	if err != nil {
+		l.release()
+		fatal(err)
+	}
+	o.m = m
+
+	if restore && dryRun {
+		var p restorePreview
+		err = previewRestore(os.Stdout, address, dirToBackup, rootDir, &o, &p)
+		l.release()
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%d files would be uploaded (%d new, %d changed, %d newer on the Duet), %d unchanged\n", p.added+p.changed+p.newer, p.added, p.changed, p.newer, p.unchanged)
+		return
+	}
+	if restore {
+		o.info("Restoring", rootDir, "to", dirToBackup)
+		err = restoreTree(address, dirToBackup, rootDir, &o)
+		l.release()
+		if err != nil {
+			fatal(err)
+		}
+		o.info("Uploaded", o.stats.added, "files")
+		return
+	}
+
+	var volChanges []int
+	if onlyIfChanged {
+		var started time.Time
+		volChanges, started, err = volumeChanges(address, &o)
+		if err != nil {
+			o.info("Cannot tell whether files changed, doing a normal run:", err)
+		} else if m.unchangedSince(volChanges, started) {
+			l.release()
+			o.info("No files changed on the Duet since the last successful run")
+			exit(noChangeExitCode)
+		}
+	}
+
+	if normalize {
+		o.normalizeExts = parseExtensions(textExtensions)
+	}
+	if incremental && !m.LastSuccess.IsZero() {
+		o.since = m.LastSuccess.Add(-incrementalOverlap)
+		o.info("Incremental mode: only considering files modified after", o.since.Format(time.RFC3339))
+	}
+
+	if journalFile != "" {
+		if o.j, err = openJournal(journalFile); err != nil {
+			l.release()
+			fatal(err)
+		}
+		if o.j.Size() > 0 {
+			o.info("Resuming interrupted run, skipping", o.j.Size(), "completed paths")
+		}
+		o.stats.captured = o.j.Files()
+	}
+
+	// Only a run that considers every file records all of them
+	fullRun := o.since.IsZero() && fileList == "" && !plugins && o.j.Size() == 0
+
+	if skipActive {
+		var job struct {
+			File struct {
+				FileName string `json:"fileName"`
+			} `json:"file"`
+		}
+		if err = queryModel(address, "job", o.listTimeout, &job); err != nil {
+			l.release()
+			fatal("Failed to query the active job: ", err)
+		}
+		o.activeFile = job.File.FileName
+		if o.activeFile != "" {
+			o.info("Currently printing", o.activeFile)
+		}
+	}
+
+	if timingFile != "" {
+		if o.timing, err = openTimingLog(timingFile); err != nil {
+			l.release()
+			fatal(err)
+		}
+	}
+
+	start := time.Now()
+	if downloadDeadline > 0 {
+		o.downloadDeadline = start.Add(downloadDeadline)
+	}
+	if fileList != "" || plugins {
+		var paths []string
+		if plugins {
+			paths, err = pluginFiles(address, &o)
+		} else {
+			paths, err = readPathList(fileList)
+		}
+		if err == nil {
+			err = syncPathList(address, dirToBackup, paths, rootDir, &o)
+		}
+	} else {
+		err = syncFolder(address, dirToBackup, rootDir, &o)
+	}
+	if err == nil {
+		saveCache(o.cache)
+		warnIfLargerThanFree(address, dirToBackup, &o)
+	}
+
+	// Too few files hint at incomplete listings so the backup must not
+	// count as successful. The journal is cleared nevertheless so the
+	// next run lists everything again instead of skipping it.
+	tooFew := err == nil && o.stats.captured < uint64(minFiles)
+	if tooFew {
+		log.Printf("Only %d files were backed up but at least %d were expected", o.stats.captured, minFiles)
+	}
+
+	// Skipped and failed files have to be considered again by the next run
+	complete := o.stats.skipped == 0 && len(o.errs) == 0 && !tooFew
+	if err == nil {
+		if complete {
+			m.LastSuccess = start
+			m.VolChanges = volChanges
+			m.Complete = m.Complete || fullRun
+		}
+		err = m.save(absPath)
+	}
+	if err == nil {
+		err = writeRestoreScripts(absPath, restoreArgs, usePassword)
+	}
+	if err == nil && (complete || tooFew) {
+		err = o.j.Clear()
+	}
+	if listingFile != "" {
+		if lerr := saveListings(listingFile, o.listings); lerr != nil {
+			log.Println("Failed to save listing:", lerr)
+		}
+	}
+	if terr := o.timing.Close(); terr != nil {
+		log.Println("Failed to write timing:", terr)
+	}
+	if metricsFile != "" {
+		if merr := writeMetrics(metricsFile, &o.stats, m.LastSuccess, time.Since(start)); merr != nil {
+			log.Println("Failed to write metrics:", merr)
+		}
+	}
+	if changelogFile != "" {
+		if cerr := appendChangelog(changelogFile, start, &o.stats, time.Since(start), err == nil && complete); cerr != nil {
+			log.Println("Failed to write changelog:", cerr)
+		}
+	}
+	if err == nil && diffAgainst != "" {
+		var changes int
+		if changes, err = writeChanges(absPath, diffAgainst); err == nil {
+			o.info("Found", changes, "changes compared to", diffAgainst)
+		}
+	}
+	if err == nil && gitMode && complete && !o.stats.unchanged() {
+		var committed bool
+		committed, err = gitCommit(absPath, "Backup of "+address+" at "+start.Format(time.RFC3339), gitPush)
+		if committed {
+			o.info("Committed changes to git")
+		}
+	}
+	if reuse != nil {
+		log.Println("Connections:", reuse)
+	}
+	l.release()
+	if err != nil {
+		fatal(err)
+	}
+	if len(o.errs) > 0 {
+		log.Println("Finished with", len(o.errs), "errors:")
+		for _, e := range o.errs {
+			log.Println(" ", e)
+		}
+	}
+	if o.stats.skipped > 0 {
+		log.Println("Skipped", o.stats.skipped, "files, they will be considered again by the next run")
+	}
+	if !complete {
+		exit(exitPartial)
+	}
+	if o.stats.unchanged() {
+		o.info("Nothing changed")
+		exit(noChangeExitCode)
 	}
 }
@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testOptions returns the options of a plain backup into outRoot
+func testOptions(outRoot string) *options {
+	return &options{
+		m:               &manifest{},
+		outRoot:         outRoot,
+		dirToBackup:     sysDir,
+		quiet:           true,
+		streamThreshold: defaultStreamThreshold,
+		rateUnit:        rateUnitKiB,
+	}
+}
+
+// tempDir creates a temporary directory and returns it together with a
+// function removing it again
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "duetbackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// checkFile fails the test if the local file does not have the given
+// content and modification time
+func checkFile(t *testing.T, fileName, content string, date time.Time) {
+	t.Helper()
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(b) != content {
+		t.Errorf("%s: got content %q, want %q", fileName, b, content)
+	}
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !fi.ModTime().Equal(date) {
+		t.Errorf("%s: got mtime %s, want %s", fileName, fi.ModTime(), date)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	d := newFakeDuet(nil)
+	defer d.close()
+
+	if err := connect(d.URL(), defaultPassword, false); err != nil {
+		t.Errorf("connect with the right password: %s", err)
+	}
+	if err := connect(d.URL(), "wrong", false); err != errWrongPassword {
+		t.Errorf("connect with a wrong password: got %v, want %v", err, errWrongPassword)
+	}
+}
+
+func TestSyncFolder(t *testing.T) {
+	d := newFakeDuet(map[string]string{
+		"0:/sys/config.g":          "M550 P\"test\"\n",
+		"0:/sys/homeall.g":         "G28\n",
+		"0:/sys/macros/a.g":        "M117 a\n",
+		"0:/sys/macros/deep/b.g":   "M117 b\n",
+		"0:/sys/macros/deep/c.csv": "1,2,3\n",
+	})
+	defer d.close()
+
+	// Force every listing to be split into several pages
+	d.pageSize = 1
+
+	outDir, remove := tempDir(t)
+	defer remove()
+	o := testOptions(outDir)
+
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(outDir, "config.g"), "M550 P\"test\"\n", fakeDate)
+	checkFile(t, filepath.Join(outDir, "homeall.g"), "G28\n", fakeDate)
+	checkFile(t, filepath.Join(outDir, "macros", "a.g"), "M117 a\n", fakeDate)
+	checkFile(t, filepath.Join(outDir, "macros", "deep", "b.g"), "M117 b\n", fakeDate)
+	checkFile(t, filepath.Join(outDir, "macros", "deep", "c.csv"), "1,2,3\n", fakeDate)
+	if o.stats.added != 5 || o.stats.updated != 0 {
+		t.Errorf("first run: got %d added and %d updated, want 5 and 0", o.stats.added, o.stats.updated)
+	}
+
+	// Nothing changed so nothing is transferred
+	o = testOptions(outDir)
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	if !o.stats.unchanged() {
+		t.Errorf("unchanged run: got %d transferred and %d removed, want none", o.stats.transferred(), o.stats.removed)
+	}
+
+	// Changed files are updated and deleted directories removed
+	later := fakeDate.Add(time.Hour)
+	d.setFile("0:/sys/homeall.g", "G28 XY\nG28 Z\n", later)
+	d.removeFile("0:/sys/macros/deep/b.g")
+	d.removeFile("0:/sys/macros/deep/c.csv")
+	o = testOptions(outDir)
+	o.removeLocal = true
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(outDir, "homeall.g"), "G28 XY\nG28 Z\n", later)
+	if _, err := os.Stat(filepath.Join(outDir, "macros", "deep")); !os.IsNotExist(err) {
+		t.Errorf("deleted remote directory was not removed locally: %v", err)
+	}
+	if o.stats.updated != 1 || o.stats.removed != 1 {
+		t.Errorf("changed run: got %d updated and %d removed, want 1 and 1", o.stats.updated, o.stats.removed)
+	}
+}
+
+func TestSyncFolderListingError(t *testing.T) {
+	d := newFakeDuet(map[string]string{
+		"0:/sys/config.g":   "G28\n",
+		"0:/sys/macros/a.g": "M117 a\n",
+	})
+	defer d.close()
+	d.listErrs["0:/sys/macros"] = 1
+
+	outDir, remove := tempDir(t)
+	defer remove()
+
+	if err := syncFolder(d.URL(), sysDir, outDir, testOptions(outDir)); err == nil {
+		t.Error("got no error for a listing reporting an error code")
+	}
+
+	// With -continueOnError the other files are still backed up
+	o := testOptions(outDir)
+	o.continueOnError = true
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.errs) != 1 {
+		t.Errorf("got %d recorded errors, want 1", len(o.errs))
+	}
+	checkFile(t, filepath.Join(outDir, "config.g"), "G28\n", fakeDate)
+}
+
+func TestFileSizeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    fileSize
+		wantErr bool
+	}{
+		{`123`, 123, false},
+		{`0`, 0, false},
+		{`"456"`, 456, false},
+		{`null`, 0, false},
+		{`"abc"`, 0, true},
+		{`-1`, 0, true},
+		{`1.5`, 0, true},
+		{`""`, 0, true},
+	}
+	for _, tt := range tests {
+		var f file
+		err := json.Unmarshal([]byte(`{"size":`+tt.json+`}`), &f)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.json, err, tt.wantErr)
+			continue
+		}
+		if err == nil && f.Size != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.json, f.Size, tt.want)
+		}
+	}
+}
+
+func TestSplitDomain(t *testing.T) {
+	tests := []struct {
+		domain  string
+		host    string
+		port    uint64
+		hasPort bool
+		address string
+		wantErr bool
+	}{
+		{"duet.lan", "duet.lan", 0, false, "http://duet.lan:80", false},
+		{"duet.lan:8080", "duet.lan", 8080, true, "http://duet.lan:8080", false},
+		{"192.168.1.10", "192.168.1.10", 0, false, "http://192.168.1.10:80", false},
+		{"192.168.1.10:81", "192.168.1.10", 81, true, "http://192.168.1.10:81", false},
+		{"fe80::1", "fe80::1", 0, false, "http://[fe80::1]:80", false},
+		{"[fe80::1]", "fe80::1", 0, false, "http://[fe80::1]:80", false},
+		{"[fe80::1]:8080", "fe80::1", 8080, true, "http://[fe80::1]:8080", false},
+		{"duet.lan:http", "", 0, false, "", true},
+		{"duet.lan:70000", "", 0, false, "", true},
+		{"[fe80::1", "", 0, false, "", true},
+	}
+	for _, tt := range tests {
+		host, port, hasPort, err := splitDomain(tt.domain)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tt.domain, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if host != tt.host || port != tt.port || hasPort != tt.hasPort {
+			t.Errorf("%s: got %q, %d, %t, want %q, %d, %t", tt.domain, host, port, hasPort, tt.host, tt.port, tt.hasPort)
+		}
+		if !hasPort {
+			port = 80
+		}
+		if address := getAddress(host, port); address != tt.address {
+			t.Errorf("%s: got address %s, want %s", tt.domain, address, tt.address)
+		}
+	}
+}
+
+func TestExcludesRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{"0:/sys/a"},
+		{"0:/sys/a", "0:/macros"},
+		{"0:/sys/a,b", "0:/sys/c"},
+		{"0:/sys/a,,b,", "./x"},
+		{`0:/sys/a\`, "0:/sys/b"},
+		{`0:/sys/a\,b`, `0:/sys/\\c`},
+		{`0:/sys/a\b`},
+	}
+	for _, excls := range tests {
+		var e excludes
+		e.excls = excls
+		s := e.String()
+
+		var parsed excludes
+		if err := parsed.Set(s); err != nil {
+			t.Errorf("%q: %s", s, err)
+			continue
+		}
+		if len(parsed.excls) != len(excls) {
+			t.Errorf("%q: got %q, want %q", s, parsed.excls, excls)
+			continue
+		}
+		for i := range excls {
+			if parsed.excls[i] != excls[i] {
+				t.Errorf("%q: got %q, want %q", s, parsed.excls, excls)
+				break
+			}
+		}
+	}
+}
+
+func TestExcludesSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"0:/sys/a", []string{"0:/sys/a"}},
+		{"0:/sys/a,0:/sys/b", []string{"0:/sys/a", "0:/sys/b"}},
+		{`0:/sys/a\,b`, []string{"0:/sys/a,b"}},
+		{`0:/sys/a\\,b`, []string{`0:/sys/a\`, "b"}},
+		{`0:/sys/a\b`, []string{`0:/sys/a\b`}},
+		{"0:/sys/a,,", []string{"0:/sys/a"}},
+		{"0:/sys//a/", []string{"0:/sys/a"}},
+	}
+	for _, tt := range tests {
+		var e excludes
+		if err := e.Set(tt.value); err != nil {
+			t.Errorf("%q: %s", tt.value, err)
+			continue
+		}
+		if len(e.excls) != len(tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.value, e.excls, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if e.excls[i] != tt.want[i] {
+				t.Errorf("%q: got %q, want %q", tt.value, e.excls, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path, want string
+	}{
+		{"0:/sys", "0:/sys"},
+		{"0:/sys/", "0:/sys"},
+		{"0://sys///macros//", "0:/sys/macros"},
+		{"/sys", "/sys"},
+		{"0:/", "0:"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := cleanPath(tt.path); got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSameDir(t *testing.T) {
+	tests := []struct {
+		requested, reported string
+		want                bool
+	}{
+		{"0:/sys", "0:/sys", true},
+		{"0:/sys", "0:/sys/", true},
+		{"0:/sys", "/sys", true},
+		{"0:/sys", "/sys/", true},
+		{"0:/sys", "sys", true},
+		{"0:/sys", "", true},
+		{"0:/sys/macros", "0:/sys/macros", true},
+		{"0:/sys/macros", "/sys/macros/", true},
+		{"1:/sys", "1:/sys", true},
+		{"1:/sys", "/sys", true},
+		{"0:/sys", "0:/macros", false},
+		{"0:/sys", "/macros", false},
+		{"0:/sys", "1:/sys", false},
+		{"0:/sys/macros", "/sys", false},
+	}
+	for _, tt := range tests {
+		if got := sameDir(tt.requested, tt.reported); got != tt.want {
+			t.Errorf("sameDir(%q, %q) = %t, want %t", tt.requested, tt.reported, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveDeletedFilesForgetsManifestEntries(t *testing.T) {
+	d := newFakeDuet(map[string]string{
+		"0:/sys/config.g":        "G28\n",
+		"0:/sys/macros/a.g":      "M117 a\n",
+		"0:/sys/macros/deep/b.g": "M117 b\n",
+	})
+	defer d.close()
+
+	outDir, remove := tempDir(t)
+	defer remove()
+	o := testOptions(outDir)
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+
+	d.removeFile("0:/sys/macros/deep/b.g")
+	m := o.m
+	o = testOptions(outDir)
+	o.m = m
+	o.removeLocal = true
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.m.Files["0:/sys/macros/deep/b.g"]; ok {
+		t.Error("manifest still has an entry for the removed 0:/sys/macros/deep/b.g")
+	}
+	for _, p := range []string{"0:/sys/config.g", "0:/sys/macros/a.g"} {
+		if _, ok := o.m.Files[p]; !ok {
+			t.Errorf("manifest lost the entry of %s", p)
+		}
+	}
+	if o.m.hasFilesIn("0:/sys/macros/deep") {
+		t.Error("manifest still knows files in the removed directory")
+	}
+}
+
+func TestFailRetryBudgetExhausted(t *testing.T) {
+	o := &options{continueOnError: true}
+	if err := o.fail("0:/sys/config.g", errors.New("timeout")); err != nil {
+		t.Errorf("fail returned %v, want nil with -continueOnError", err)
+	}
+	if err := o.fail("0:/sys/homeall.g", errRetryBudgetExhausted); err != errRetryBudgetExhausted {
+		t.Errorf("fail returned %v, want %v", err, errRetryBudgetExhausted)
+	}
+	if len(o.errs) != 1 {
+		t.Errorf("got %d recorded errors, want 1", len(o.errs))
+	}
+}
+
+func TestGetFileListHiddenFallback(t *testing.T) {
+	d := newFakeDuet(map[string]string{"0:/sys/config.g": "G28\n"})
+	defer d.close()
+
+	// A rejected request disables listing hidden files
+	d.rejectHidden = true
+	o := testOptions("")
+	o.showHidden = true
+	fl, err := getFileList(d.URL(), sysDir, 0, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fl.Files) != 1 || o.showHidden {
+		t.Errorf("got %d files with showHidden %v, want 1 file and showHidden disabled", len(fl.Files), o.showHidden)
+	}
+
+	// Transport errors keep it enabled
+	url := d.URL()
+	d.srv.Close()
+	o.showHidden = true
+	if _, err = getFileList(url, sysDir, 0, o); err == nil {
+		t.Fatal("listing succeeded although the Duet is gone")
+	}
+	if !o.showHidden {
+		t.Error("showHidden was disabled after a transport error")
+	}
+}
+
+func TestSyncFolderRecordsUnchangedFiles(t *testing.T) {
+	d := newFakeDuet(map[string]string{
+		"0:/sys/config.g":   "G28\n",
+		"0:/sys/macros/a.g": "M117 a\n",
+	})
+	defer d.close()
+
+	outDir, remove := tempDir(t)
+	defer remove()
+	if err := syncFolder(d.URL(), sysDir, outDir, testOptions(outDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A backup made before the manifest existed has no entries
+	o := testOptions(outDir)
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	if o.stats.added != 0 || o.stats.updated != 0 {
+		t.Errorf("got %d added and %d updated files, want none", o.stats.added, o.stats.updated)
+	}
+	for _, p := range []string{"0:/sys/config.g", "0:/sys/macros/a.g"} {
+		e, ok := o.m.Files[p]
+		if !ok {
+			t.Errorf("manifest has no entry for the unchanged %s", p)
+			continue
+		}
+		if e.Size == 0 || e.RemoteDate == nil || !e.RemoteDate.Equal(fakeDate) {
+			t.Errorf("entry of %s has size %d and date %v, want the remote ones", p, e.Size, e.RemoteDate)
+		}
+	}
+}
+
+func TestNeedsRemoveConfirmation(t *testing.T) {
+	tests := []struct {
+		files []string
+		want  bool
+	}{
+		{nil, false},
+		{[]string{"config.g"}, true},
+		{[]string{"config.g", dirMarker}, false},
+		{[]string{"config.g", manifestFile}, false},
+	}
+	for _, tt := range tests {
+		dir, remove := tempDir(t)
+		for _, name := range tt.files {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := needsRemoveConfirmation(dir); got != tt.want {
+			t.Errorf("needsRemoveConfirmation(%v) = %v, want %v", tt.files, got, tt.want)
+		}
+		remove()
+	}
+}
+
+func TestStreamable(t *testing.T) {
+	big := fileSize(defaultStreamThreshold + 1)
+	tests := []struct {
+		name     string
+		size     fileSize
+		validate bool
+		want     bool
+	}{
+		{"job.gcode", big, false, true},
+		{"job.gcode", 1, false, false},
+		{"config.g", big, false, true},
+		{"config.g", big, true, false},
+		{"job.gcode", big, true, true},
+	}
+	for _, tt := range tests {
+		o := testOptions("")
+		o.validateConfig = tt.validate
+		if got := o.streamable(file{Name: tt.name, Size: tt.size}, nil); got != tt.want {
+			t.Errorf("streamable(%s, %d) with validateConfig %v = %v, want %v", tt.name, tt.size, tt.validate, got, tt.want)
+		}
+	}
+}
+
+func TestSyncFolderDeepVerify(t *testing.T) {
+	d := newFakeDuet(map[string]string{"0:/sys/config.g": "G28\n"})
+	defer d.close()
+
+	outDir, remove := tempDir(t)
+	defer remove()
+	o := testOptions(outDir)
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+
+	// Up-to-date files are only hashed
+	m := o.m
+	o = testOptions(outDir)
+	o.m = m
+	o.deepVerify = true
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	if o.stats.transferred() != 0 {
+		t.Errorf("verified run: got %d transferred files, want none", o.stats.transferred())
+	}
+
+	// Content that changed without a new date is downloaded again
+	d.setFile("0:/sys/config.g", "G28 X\n", fakeDate)
+	o = testOptions(outDir)
+	o.m = m
+	o.deepVerify = true
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	if o.stats.updated != 1 {
+		t.Errorf("changed run: got %d updated files, want 1", o.stats.updated)
+	}
+	checkFile(t, filepath.Join(outDir, "config.g"), "G28 X\n", fakeDate)
+}
+
+func TestSyncFolderStoreCompressedLater(t *testing.T) {
+	d := newFakeDuet(map[string]string{
+		"0:/sys/config.g":   "G28\n",
+		"0:/sys/macros/a.g": "M117 a\n",
+	})
+	defer d.close()
+
+	outDir, remove := tempDir(t)
+	defer remove()
+	o := testOptions(outDir)
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+
+	// The uncompressed copies are replaced by compressed ones
+	m := o.m
+	o = testOptions(outDir)
+	o.m = m
+	o.storeCompressed = true
+	o.removeLocal = true
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"config.g", filepath.Join("macros", "a.g")} {
+		if _, err := os.Stat(filepath.Join(outDir, name)); !os.IsNotExist(err) {
+			t.Errorf("uncompressed %s was not removed: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(outDir, name+compressedSuffix)); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// optsEnv names the environment variable holding additional flags
+const optsEnv = "DUETBACKUP_OPTS"
+
+// splitArgs splits s into arguments like a POSIX shell would do without
+// any expansion. Single quotes preserve everything literally, double
+// quotes allow escaping " and \ and outside of quotes a backslash
+// escapes any character.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				cur.WriteRune('\\')
+			}
+			cur.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape in " + optsEnv)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+// argsWithEnv returns the command-line arguments preceded by those from
+// the environment so the command-line takes precedence
+func argsWithEnv() ([]string, error) {
+	envArgs, err := splitArgs(os.Getenv(optsEnv))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, len(envArgs)+len(os.Args))
+	args = append(args, os.Args[0])
+	args = append(args, envArgs...)
+	return append(args, os.Args[1:]...), nil
+}
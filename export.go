@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// exportEntry is a single file of an export. Content is encoded as base64
+// by encoding/json.
+type exportEntry struct {
+	Path    string    `json:"path"`
+	Size    int       `json:"size"`
+	Date    localTime `json:"date"`
+	SHA256  string    `json:"sha256"`
+	Content []byte    `json:"content"`
+}
+
+// writeExport writes all files below dir as a single JSON document of the
+// form {"source":..., "dir":..., "created":..., "files":[...]} to path.
+// Files are downloaded and written one after another so only one of them
+// is held in memory at a time.
+func writeExport(address, dir, path string, o *options) error {
+	fl, err := listTree(address, dir, o)
+	if err != nil {
+		return err
+	}
+	var files []file
+	var paths []string
+	collectTreeFiles(fl, o, &files, &paths)
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = streamExport(w, address, dir, files, paths, o)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func streamExport(w *bufio.Writer, address, dir string, files []file, paths []string, o *options) error {
+	header, err := json.Marshal(struct {
+		Source  string    `json:"source"`
+		Dir     string    `json:"dir"`
+		Created time.Time `json:"created"`
+	}{address, dir, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	// Leave the header object open to append the files to it
+	fmt.Fprintf(w, "%s,\"files\":[", header[:len(header)-1])
+	enc := json.NewEncoder(w)
+	for i, p := range paths {
+		body, _, err := download(downloadRequestURL(address, p), o.fileTimeout(files[i].Size))
+		if err != nil {
+			return fmt.Errorf("%s: %s", p, err)
+		}
+		if i > 0 {
+			w.WriteString(",")
+		}
+		if err = enc.Encode(exportEntry{Path: p, Size: len(body), Date: files[i].Date, SHA256: sha256Hex(body), Content: body}); err != nil {
+			return err
+		}
+		o.stats.added++
+		o.stats.bytes += uint64(len(body))
+		if o.verbose {
+			log.Println("  Exported:  ", p)
+		}
+	}
+	_, err = w.WriteString("]}\n")
+	return err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeDuet emulates the rr_* requests of a standalone Duet serving the
+// files of an in-memory tree
+type fakeDuet struct {
+	mu       sync.Mutex
+	files    map[string]fakeFile
+	password string
+
+	// pageSize is the number of entries per rr_filelist response; more
+	// have to be requested with first. 0 returns all entries at once.
+	pageSize int
+
+	// listErrs holds the err code reported when listing a directory
+	listErrs map[string]int
+
+	// rejectHidden answers listings requesting hidden files with an
+	// HTTP error like old firmware versions
+	rejectHidden bool
+
+	// rejectTime answers uploads passing a modification time with an
+	// HTTP error and uploadErr is the err code reported for any upload
+	rejectTime bool
+	uploadErr  int
+
+	srv *httptest.Server
+
+	// client and mode are restored by close
+	client *http.Client
+	mode   string
+}
+
+// fakeFile is a remote file of a fakeDuet
+type fakeFile struct {
+	content []byte
+	date    time.Time
+}
+
+// fakeDate is the modification time of all files created by newFakeDuet
+var fakeDate = time.Date(2019, 6, 1, 12, 0, 0, 0, time.Local)
+
+// newFakeDuet starts a fake Duet serving files given by their remote
+// path and content. It sets up httpClient and apiMode to talk to it
+// until close is called.
+func newFakeDuet(files map[string]string) *fakeDuet {
+	d := &fakeDuet{files: make(map[string]fakeFile), password: defaultPassword, listErrs: make(map[string]int)}
+	for p, content := range files {
+		d.files[p] = fakeFile{content: []byte(content), date: fakeDate}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rr_connect", d.handleConnect)
+	mux.HandleFunc("/rr_filelist", d.handleFilelist)
+	mux.HandleFunc("/rr_download", d.handleDownload)
+	mux.HandleFunc("/rr_upload", d.handleUpload)
+	d.srv = httptest.NewServer(mux)
+
+	d.client, d.mode = httpClient, apiMode
+	httpClient, apiMode = d.srv.Client(), apiRR
+	return d
+}
+
+// URL returns the base URL of the fake Duet
+func (d *fakeDuet) URL() string {
+	return d.srv.URL
+}
+
+// close stops the server and restores httpClient and apiMode
+func (d *fakeDuet) close() {
+	d.srv.Close()
+	httpClient, apiMode = d.client, d.mode
+}
+
+// setFile creates or replaces a remote file
+func (d *fakeDuet) setFile(remotePath, content string, date time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files[remotePath] = fakeFile{content: []byte(content), date: date}
+}
+
+// removeFile deletes a remote file
+func (d *fakeDuet) removeFile(remotePath string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.files, remotePath)
+}
+
+func (d *fakeDuet) handleConnect(w http.ResponseWriter, r *http.Request) {
+	code := 0
+	if r.FormValue("password") != d.password {
+		code = 1
+	}
+	writeJSON(w, map[string]int{"err": code})
+}
+
+func (d *fakeDuet) handleFilelist(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.rejectHidden && r.FormValue("hidden") != "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	dir := r.FormValue("dir")
+	if code, ok := d.listErrs[dir]; ok {
+		writeJSON(w, map[string]int{"err": code})
+		return
+	}
+
+	// Collect the direct children of dir, subdirectories are implied by
+	// the paths of the files below them
+	entries := make(map[string]file)
+	for p, f := range d.files {
+		if !strings.HasPrefix(p, dir+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(p, dir+"/")
+		if i := strings.Index(rest, "/"); i >= 0 {
+			entries[rest[:i]] = file{Type: typeDirectory, Name: rest[:i], Date: localTime{fakeDate}}
+			continue
+		}
+		entries[rest] = file{Type: typeFile, Name: rest, Size: fileSize(len(f.content)), Date: localTime{f.date}}
+	}
+	if len(entries) == 0 {
+		writeJSON(w, map[string]int{"err": 2})
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	first, _ := strconv.Atoi(r.FormValue("first"))
+	if first > len(names) {
+		first = len(names)
+	}
+	last := len(names)
+	if d.pageSize > 0 && first+d.pageSize < last {
+		last = first + d.pageSize
+	}
+	fl := filelist{Dir: dir, Files: []file{}}
+	for _, name := range names[first:last] {
+		fl.Files = append(fl.Files, entries[name])
+	}
+	if last < len(names) {
+		fl.Next = uint64(last)
+	}
+	writeJSON(w, fl)
+}
+
+func (d *fakeDuet) handleDownload(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	f, ok := d.files[r.FormValue("name")]
+	d.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(f.content)
+}
+
+func (d *fakeDuet) handleUpload(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.rejectTime && r.FormValue("time") != "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if d.uploadErr != 0 {
+		writeJSON(w, map[string]int{"err": d.uploadErr})
+		return
+	}
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	date := time.Now()
+	if t := r.FormValue("time"); t != "" {
+		if date, err = time.ParseInLocation("2006-01-02T15:04:05", t, time.Local); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	d.files[r.FormValue("name")] = fakeFile{content: content, date: date}
+	writeJSON(w, map[string]int{"err": 0})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
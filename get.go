@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// getFile downloads a single remote file without listing its directory.
+// It is written to outDir with its remote name or to stdout if outDir is
+// empty and the local file name is returned.
+func getFile(address, remotePath, outDir string, o *options) (string, error) {
+	body, _, err := download(downloadRequestURL(address, remotePath), o.downloadTimeout)
+	if err != nil {
+		return "", err
+	}
+	if outDir == "" {
+		_, err = os.Stdout.Write(body)
+		return "", err
+	}
+
+	if err = os.MkdirAll(outDir, 0755); err != nil {
+		return "", err
+	}
+	fileName := filepath.Join(outDir, path.Base(remotePath))
+	tmp := fileName + ".tmp"
+	if err = ioutil.WriteFile(tmp, body, 0644); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return fileName, os.Rename(tmp, fileName)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// runGit runs a git command in dir and includes its output in the error
+func runGit(dir string, args ...string) error {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s failed: %s: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// checkGitRepository makes sure dir is within a git work tree
+func checkGitRepository(dir string) error {
+	return runGit(dir, "rev-parse", "--is-inside-work-tree")
+}
+
+// gitCommit stages all changes in dir except the lock file and commits
+// them with the given message. It reports whether a commit was created,
+// which is not the case if nothing changed. With push the commit is
+// pushed to the default remote afterwards.
+func gitCommit(dir, message string, push bool) (bool, error) {
+	if err := runGit(dir, "add", "-A", "--", ".", ":(exclude)"+lockFile); err != nil {
+		return false, err
+	}
+
+	// diff exits with 1 if there are staged changes
+	if runGit(dir, "diff", "--cached", "--quiet") == nil {
+		return false, nil
+	}
+	if err := runGit(dir, "commit", "-q", "-m", message); err != nil {
+		return false, err
+	}
+	if push {
+		if err := runGit(dir, "push", "-q"); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// globPatterns select local files and directories, e.g. those that
+// -removeLocal must never remove. Patterns containing a slash are
+// matched against the path relative to outDir, all others against the
+// name only.
+type globPatterns []string
+
+func (k *globPatterns) String() string {
+	if k == nil {
+		return ""
+	}
+	return strings.Join(*k, ",")
+}
+
+func (k *globPatterns) Set(value string) error {
+	value = strings.TrimSuffix(filepath.ToSlash(value), "/")
+	if _, err := path.Match(value, ""); err != nil {
+		return err
+	}
+	*k = append(*k, value)
+	return nil
+}
+
+// Matches checks whether the local file at the given path relative to
+// outDir is selected by any of the patterns
+func (k globPatterns) Matches(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, p := range k {
+		var ok bool
+		if strings.Contains(p, "/") {
+			ok, _ = path.Match(strings.TrimPrefix(p, "/"), relPath)
+		} else {
+			ok, _ = path.Match(p, path.Base(relPath))
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
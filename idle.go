@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// idlePollInterval is the time between two status queries while waiting
+// for the Duet to become idle. It is shorter than the default session
+// timeout of the firmware so the session is kept alive.
+const idlePollInterval = 5 * time.Second
+
+// busyStates are the machine states during which a backup would compete
+// with a running print for the bandwidth of the Duet
+var busyStates = map[string]bool{
+	"processing": true,
+	"simulating": true,
+	"pausing":    true,
+	"paused":     true,
+	"resuming":   true,
+}
+
+// machineStatus returns the current state.status of the object model
+func machineStatus(address string, o *options) (string, error) {
+	var status string
+	err := queryModel(address, "state.status", o.listTimeout, &status)
+	return status, err
+}
+
+// waitIdle polls the Duet until it is no longer busy or maxWait has
+// passed. It returns the last status and whether it is still busy.
+func waitIdle(address string, maxWait time.Duration, o *options) (string, bool, error) {
+	deadline := time.Now().Add(maxWait)
+	for {
+		status, err := machineStatus(address, o)
+		if err != nil {
+			return "", false, err
+		}
+		if !busyStates[status] || !time.Now().Before(deadline) {
+			return status, busyStates[status], nil
+		}
+		if o.verbose {
+			log.Println("Duet is", status+", waiting for it to become idle")
+		}
+		wait := idlePollInterval
+		if remaining := time.Until(deadline); remaining < wait {
+			wait = remaining
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"strings"
+)
+
+// ignoreFileName is the name of files on the Duet listing patterns of
+// files and directories in the same directory and below that are not
+// backed up
+const ignoreFileName = ".duetbackupignore"
+
+// ignoreFile holds the patterns of an ignore file found in dir.
+// Patterns containing a slash are matched against the path relative to
+// dir, all others against the name of every file and directory below dir.
+type ignoreFile struct {
+	dir      string
+	patterns []string
+}
+
+// parseIgnoreFile reads the patterns from the content of an ignore file.
+// Empty lines and lines starting with # are skipped.
+func parseIgnoreFile(dir string, content []byte) ignoreFile {
+	ign := ignoreFile{dir: dir}
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ign.patterns = append(ign.patterns, strings.TrimSuffix(line, "/"))
+	}
+	return ign
+}
+
+// Matches checks whether remotePath is covered by one of the patterns
+func (ign ignoreFile) Matches(remotePath string) bool {
+	if !strings.HasPrefix(remotePath, ign.dir+"/") {
+		return false
+	}
+	rel := strings.TrimPrefix(remotePath, ign.dir+"/")
+	for _, p := range ign.patterns {
+		var ok bool
+		if strings.Contains(p, "/") {
+			ok, _ = path.Match(strings.TrimPrefix(p, "/"), rel)
+		} else {
+			ok, _ = path.Match(p, path.Base(rel))
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// loadIgnoreFile downloads the ignore file of the listed directory if it
+// has one and adds it to o.ignores
+func loadIgnoreFile(address string, fl *filelist, o *options) error {
+	if !fl.hasFile(ignoreFileName) {
+		return nil
+	}
+	content, _, err := download(downloadRequestURL(address, fl.Dir+"/"+ignoreFileName), o.listTimeout)
+	if err != nil {
+		return err
+	}
+	o.ignores = append(o.ignores, parseIgnoreFile(fl.Dir, content))
+	return nil
+}
+
+// ignored checks whether remotePath is covered by any of the ignore
+// files found so far
+func (o *options) ignored(remotePath string) bool {
+	for _, ign := range o.ignores {
+		if ign.Matches(remotePath) {
+			return true
+		}
+	}
+	return false
+}
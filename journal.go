@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// dirEntry returns the entry of a completed directory. The trailing
+// slash tells it apart from a file of the same name.
+func dirEntry(dir string) string {
+	return dir + "/"
+}
+
+// journal records remote paths that have been completely processed so
+// an interrupted run can skip them when it is started again.
+// All methods can be called on a nil journal in which case they do nothing.
+type journal struct {
+	f    *os.File
+	done map[string]struct{}
+}
+
+// openJournal reads an existing journal and opens it for appending
+func openJournal(path string) (*journal, error) {
+	j := &journal{done: make(map[string]struct{})}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := s.Text(); line != "" {
+			j.done[line] = struct{}{}
+		}
+	}
+	if err = s.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.f = f
+	return j, nil
+}
+
+// Size returns the number of completed entries
+func (j *journal) Size() int {
+	if j == nil {
+		return 0
+	}
+	return len(j.done)
+}
+
+// Files returns the number of completed files
+func (j *journal) Files() uint64 {
+	if j == nil {
+		return 0
+	}
+	var n uint64
+	for p := range j.done {
+		if !strings.HasSuffix(p, "/") {
+			n++
+		}
+	}
+	return n
+}
+
+// Contains checks whether the given remote path was completed before
+func (j *journal) Contains(remotePath string) bool {
+	if j == nil {
+		return false
+	}
+	_, ok := j.done[remotePath]
+	return ok
+}
+
+// Complete marks the given remote path as done
+func (j *journal) Complete(remotePath string) error {
+	if j == nil {
+		return nil
+	}
+	j.done[remotePath] = struct{}{}
+	_, err := j.f.WriteString(remotePath + "\n")
+	return err
+}
+
+// Clear removes the journal after a successful run
+func (j *journal) Clear() error {
+	if j == nil {
+		return nil
+	}
+	j.f.Close()
+	return os.Remove(j.f.Name())
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// listTree recursively fetches the listing of dir and all its
+// subdirectories not covered by an exclude pattern or an ignore file.
+// The ignore files found are added to o.ignores.
+func listTree(address, dir string, o *options) (*filelist, error) {
+	fl, err := getFileList(address, dir, 0, o)
+	if err != nil {
+		return nil, err
+	}
+	if err = loadIgnoreFile(address, fl, o); err != nil {
+		return nil, err
+	}
+	for _, f := range fl.Files {
+		if f.Type != typeDirectory {
+			continue
+		}
+		remoteDir := fl.Dir + "/" + f.Name
+		if o.excls.Contains(remoteDir) || o.ignored(remoteDir) {
+			continue
+		}
+		sub, err := listTree(address, remoteDir, o)
+		if err != nil {
+			return nil, err
+		}
+		fl.Subdirs = append(fl.Subdirs, sub)
+	}
+	return fl, nil
+}
+
+// printTree writes one line per file and directory of the tree
+func printTree(w io.Writer, fl *filelist, o *options) {
+	subdirs := make(map[string]*filelist)
+	for _, sub := range fl.Subdirs {
+		subdirs[sub.Dir] = sub
+	}
+	for _, f := range fl.Files {
+		remotePath := fl.Dir + "/" + f.Name
+		if o.excls.Contains(remotePath) || o.ignored(remotePath) {
+			continue
+		}
+		if f.Type == typeDirectory {
+			fmt.Fprintf(w, "%s %10s %s %s/\n", f.Type, "", f.Date.Time.Format("2006-01-02 15:04:05"), remotePath)
+			if sub, ok := subdirs[remotePath]; ok {
+				printTree(w, sub, o)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s %10d %s %s\n", f.Type, f.Size, f.Date.Time.Format("2006-01-02 15:04:05"), remotePath)
+	}
+}
+
+// writeTreeJSON writes the tree as one nested JSON document
+func writeTreeJSON(w io.Writer, fl *filelist) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(fl)
+}
+
+// saveListings writes the listings of all visited directories as a JSON
+// array to the given file
+func saveListings(path string, listings []*filelist) error {
+	b, err := json.MarshalIndent(listings, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestListTreeIgnoreFile(t *testing.T) {
+	d := newFakeDuet(map[string]string{
+		"0:/sys/" + ignoreFileName: "*.bin\nold\n",
+		"0:/sys/config.g":          "G28\n",
+		"0:/sys/firmware.bin":      "binary",
+		"0:/sys/old/a.g":           "M117 a\n",
+		"0:/sys/macros/b.g":        "M117 b\n",
+		"0:/sys/macros/c.bin":      "binary",
+	})
+	defer d.close()
+
+	outDir, remove := tempDir(t)
+	defer remove()
+
+	// The ignored files are neither listed nor backed up
+	o := testOptions(outDir)
+	fl, err := listTree(d.URL(), sysDir, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	printTree(&buf, fl, o)
+	for _, ignored := range []string{"firmware.bin", "old", "c.bin"} {
+		if strings.Contains(buf.String(), ignored) {
+			t.Errorf("ignored %s is listed:\n%s", ignored, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), "0:/sys/macros/b.g") {
+		t.Errorf("0:/sys/macros/b.g is not listed:\n%s", buf.String())
+	}
+
+	if err = syncFolder(d.URL(), sysDir, outDir, testOptions(outDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verifying does not report the ignored files as missing
+	o = testOptions(outDir)
+	if fl, err = listTree(d.URL(), sysDir, o); err != nil {
+		t.Fatal(err)
+	}
+	var res verifyResult
+	buf.Reset()
+	if err = verifyTree(&buf, fl, outDir, o, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.missing != 0 || res.mismatched != 0 || res.extra != 0 {
+		t.Errorf("got %d missing, %d different and %d extra files, want none:\n%s", res.missing, res.mismatched, res.extra, buf.String())
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lockFile         = ".duetbackup.lock"
+	lockPollInterval = 500 * time.Millisecond
+
+	// staleLockAge is the age after which a lock is considered stale
+	// even if a process with its PID exists since the PID might have
+	// been reused after a reboot
+	staleLockAge = 24 * time.Hour
+)
+
+var errLocked = errors.New("another instance is already running on this directory")
+
+// lock represents an acquired lock file
+type lock struct {
+	path string
+	once sync.Once
+}
+
+// acquireLock will exclusively create the lock file inside outDir. If it
+// already exists it will poll for up to wait before giving up with errLocked.
+// A stale lock left behind by an instance that was killed is removed.
+func acquireLock(outDir string, wait time.Duration) (*lock, error) {
+	path := filepath.Join(outDir, lockFile)
+	deadline := time.Now().Add(wait)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			// Store our PID and host to identify a stale lock
+			host, _ := os.Hostname()
+			_, err = fmt.Fprintf(f, "%d %s\n", os.Getpid(), host)
+			f.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &lock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if reason, stale := staleLock(path); stale {
+			log.Println("Removing stale lock since", reason)
+			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errLocked
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// staleLock checks whether the lock file at path was left behind by an
+// instance that is not running anymore and returns the reason. The PID
+// can only be checked if the lock was created on this host.
+func staleLock(path string) (string, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+	if age := time.Since(fi.ModTime()); age > staleLockAge {
+		return fmt.Sprintf("it is %s old", age.Round(time.Minute)), true
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+
+	// The lock might still be written to so an empty one is not stale
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return "", false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "", false
+	}
+	if host, _ := os.Hostname(); len(fields) > 1 && fields[1] != host {
+		return "", false
+	}
+	// Our own PID means it was reused, e.g. in a container
+	if pid != os.Getpid() && processExists(pid) {
+		return "", false
+	}
+	return fmt.Sprintf("process %d is not running anymore", pid), true
+}
+
+// release removes the lock file. It is safe to call it multiple times.
+func (l *lock) release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		os.Remove(l.path)
+	})
+}
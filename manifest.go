@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifestFile = ".duetbackup.manifest"
+
+// manifest holds information about previous runs. It is stored as JSON
+// in the root of outDir.
+type manifest struct {
+	LastSuccess time.Time                 `json:"lastSuccess"`
+	Files       map[string]*manifestEntry `json:"files,omitempty"`
+
+	// Complete is set once a full run recorded every file of the backup.
+	// Before that a file without an entry might still be part of it,
+	// e.g. if the backup was made by a version without a manifest.
+	Complete bool `json:"complete,omitempty"`
+
+	// VolChanges are the change counters of the volumes of the Duet at
+	// the start of the last successful run
+	VolChanges []int `json:"volChanges,omitempty"`
+}
+
+// manifestEntry holds information about a single file keyed by its
+// remote path
+type manifestEntry struct {
+	// SHA256 is the hex encoded SHA-256 hash of the content as
+	// downloaded from the Duet
+	SHA256 string `json:"sha256,omitempty"`
+
+	// LineEndings records the original line endings of a file whose
+	// line endings were normalized to LF
+	LineEndings string `json:"lineEndings,omitempty"`
+
+	// Compressed marks files that are stored gzipped
+	Compressed bool `json:"compressed,omitempty"`
+
+	// Decompressed marks .gz files that are stored gunzipped without
+	// their suffix
+	Decompressed bool `json:"decompressed,omitempty"`
+
+	// Redacted marks files of which lines were replaced so they
+	// cannot be restored as they are
+	Redacted bool `json:"redacted,omitempty"`
+
+	// Size is the size reported by the Duet
+	Size uint64 `json:"size,omitempty"`
+
+	// LastSeen is the last time the file was listed on the Duet
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+
+	// RemoteDate is the date reported by the Duet when the file was
+	// written and LocalMtime the modification time the filesystem
+	// actually stored for it, which might have been rounded
+	RemoteDate *time.Time `json:"remoteDate,omitempty"`
+	LocalMtime *time.Time `json:"localMtime,omitempty"`
+}
+
+// unchanged checks whether the remote date is still the one the local
+// file was written for and the local file was not modified since
+func (m *manifest) unchanged(remotePath string, remoteDate, localMtime time.Time) bool {
+	e, ok := m.Files[remotePath]
+	return ok && e.RemoteDate != nil && e.LocalMtime != nil &&
+		e.RemoteDate.Equal(remoteDate) && e.LocalMtime.Equal(localMtime)
+}
+
+// hasFilesIn checks whether any file directly in the remote directory
+// is known from a previous run
+func (m *manifest) hasFilesIn(dir string) bool {
+	for remotePath := range m.Files {
+		if path.Dir(remotePath) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// forget removes the entries of a remote file or of all files below a
+// remote directory
+func (m *manifest) forget(remotePath string) {
+	for p := range m.Files {
+		if p == remotePath || strings.HasPrefix(p, remotePath+"/") {
+			delete(m.Files, p)
+		}
+	}
+}
+
+// entry returns the manifest entry for the given remote path and
+// creates it if it does not exist yet
+func (m *manifest) entry(remotePath string) *manifestEntry {
+	if m.Files == nil {
+		m.Files = make(map[string]*manifestEntry)
+	}
+	e, ok := m.Files[remotePath]
+	if !ok {
+		e = &manifestEntry{}
+		m.Files[remotePath] = e
+	}
+	return e
+}
+
+// loadManifest reads the manifest from outDir. A missing manifest
+// is not an error but results in an empty one.
+func loadManifest(outDir string) (*manifest, error) {
+	m := &manifest{}
+	b, err := ioutil.ReadFile(filepath.Join(outDir, manifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// save atomically replaces the manifest in outDir by writing to a
+// temporary file first and renaming it afterwards
+func (m *manifest) save(outDir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(outDir, manifestFile)
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// sha256Hex returns the hex encoded SHA-256 hash of content
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
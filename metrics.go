@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runStats collects numbers about the current run
+type runStats struct {
+	added   uint64
+	updated uint64
+	removed uint64
+	skipped uint64
+	bytes   uint64
+
+	// captured is the number of files in the backup including those of
+	// an interrupted previous run
+	captured uint64
+
+	// remoteBytes is the size of all files covered by the backup
+	remoteBytes uint64
+}
+
+// transferred returns the number of files that were downloaded
+func (s *runStats) transferred() uint64 {
+	return s.added + s.updated
+}
+
+// unchanged reports whether no file was transferred or removed
+func (s *runStats) unchanged() bool {
+	return s.transferred() == 0 && s.removed == 0
+}
+
+// writeMetrics writes the statistics of a run in the Prometheus text
+// exposition format. The file is replaced atomically so a collector
+// never sees a partially written file.
+func writeMetrics(path string, s *runStats, lastSuccess time.Time, duration time.Duration) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# HELP duetbackup_files_total Number of files transferred by the last run.")
+	fmt.Fprintln(w, "# TYPE duetbackup_files_total gauge")
+	fmt.Fprintln(w, "duetbackup_files_total", s.transferred())
+	fmt.Fprintln(w, "# HELP duetbackup_bytes_total Number of bytes transferred by the last run.")
+	fmt.Fprintln(w, "# TYPE duetbackup_bytes_total gauge")
+	fmt.Fprintln(w, "duetbackup_bytes_total", s.bytes)
+	fmt.Fprintln(w, "# HELP duetbackup_last_success_timestamp Unix time of the last successful run.")
+	fmt.Fprintln(w, "# TYPE duetbackup_last_success_timestamp gauge")
+	if lastSuccess.IsZero() {
+		fmt.Fprintln(w, "duetbackup_last_success_timestamp", 0)
+	} else {
+		fmt.Fprintln(w, "duetbackup_last_success_timestamp", lastSuccess.Unix())
+	}
+	fmt.Fprintln(w, "# HELP duetbackup_duration_seconds Duration of the last run in seconds.")
+	fmt.Fprintln(w, "# TYPE duetbackup_duration_seconds gauge")
+	fmt.Fprintf(w, "duetbackup_duration_seconds %.3f\n", duration.Seconds())
+	err = w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// ownership describes the owner and group applied to created files and
+// directories. An ID of -1 leaves the respective value unchanged.
+type ownership struct {
+	uid    int
+	gid    int
+	strict bool
+}
+
+// resolveUser turns a user name or numeric ID into a user ID
+func resolveUser(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// resolveGroup turns a group name or numeric ID into a group ID
+func resolveGroup(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// apply sets owner and group of path. Failures are only logged
+// unless strict ownership was requested.
+func (ow ownership) apply(path string) error {
+	if ow.uid < 0 && ow.gid < 0 {
+		return nil
+	}
+	err := chown(path, ow.uid, ow.gid)
+	if err != nil && !ow.strict {
+		log.Println("  Failed to change ownership of", path+":", err)
+		return nil
+	}
+	return err
+}
+
+// mkdirAll creates path along with all missing parents like os.MkdirAll
+// and applies the ownership to every directory it created
+func (ow ownership) mkdirAll(path string) error {
+	var created []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			break
+		}
+		created = append(created, dir)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := ow.apply(created[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestOwnershipMkdirAll(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+	root, remove := tempDir(t)
+	defer remove()
+
+	ow := ownership{uid: 65534, gid: 65534}
+	if err := ow.mkdirAll(filepath.Join(root, "a", "b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	owner := func(dir string) int {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(fi.Sys().(*syscall.Stat_t).Uid)
+	}
+	if uid := owner(root); uid != os.Geteuid() {
+		t.Errorf("existing %s is owned by %d, want it unchanged", root, uid)
+	}
+	for _, dir := range []string{"a", filepath.Join("a", "b"), filepath.Join("a", "b", "c")} {
+		if uid := owner(filepath.Join(root, dir)); uid != ow.uid {
+			t.Errorf("%s is owned by %d, want %d", dir, uid, ow.uid)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// readPathList reads a newline-separated list of remote file paths.
+// Empty lines and lines starting with # are ignored.
+func readPathList(fileName string) ([]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, cleanPath(line))
+	}
+	return paths, s.Err()
+}
+
+// syncPathList downloads the given remote files below dirToBackup
+// without ever requesting a directory listing. Since nothing is known
+// about the remote files they are always downloaded.
+func syncPathList(address, dirToBackup string, paths []string, outDir string, o *options) error {
+	lists := make(map[string]*filelist)
+	for _, p := range paths {
+		if !strings.HasPrefix(p, dirToBackup+"/") {
+			return fmt.Errorf("%s is not located below %s", p, dirToBackup)
+		}
+		dir := path.Dir(p)
+		fl, ok := lists[dir]
+		if !ok {
+			fl = &filelist{Dir: dir}
+			lists[dir] = fl
+		}
+		fl.Files = append(fl.Files, file{Type: typeFile, Name: path.Base(p)})
+	}
+
+	dirs := make([]string, 0, len(lists))
+	for dir := range lists {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		localDir := filepath.Join(outDir, filepath.FromSlash(strings.TrimPrefix(dir, dirToBackup)))
+		o.info("Downloading listed files from", dir, "to", localDir)
+		if err := updateLocalFiles(address, lists[dir], localDir, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"sort"
+)
+
+const (
+	// webDir is where DWC files of plugins are installed
+	webDir = "0:/www"
+
+	// sdRoot is what plugin SD files are relative to
+	sdRoot = "0:"
+)
+
+// pluginExcludes match files of plugins that can be regenerated and
+// therefore do not need to be backed up
+var pluginExcludes = []*regexp.Regexp{
+	regexp.MustCompile(`/__pycache__/`),
+	regexp.MustCompile(`\.map$`),
+}
+
+// plugin resembles the parts of a plugin in the object model needed to
+// find its files on the Duet
+type plugin struct {
+	ID       string   `json:"id"`
+	DwcFiles []string `json:"dwcFiles"`
+	SdFiles  []string `json:"sdFiles"`
+}
+
+// pluginFiles queries the installed plugins and returns the remote
+// paths of all their files below sdRoot
+func pluginFiles(address string, o *options) ([]string, error) {
+	var plugins map[string]plugin
+	if err := queryModel(address, "plugins", o.listTimeout, &plugins); err != nil {
+		return nil, err
+	}
+	var paths []string
+	for id, p := range plugins {
+		o.info("Found plugin", id, "with", len(p.DwcFiles)+len(p.SdFiles), "files")
+		for _, f := range p.DwcFiles {
+			paths = append(paths, path.Join(webDir, f))
+		}
+		for _, f := range p.SdFiles {
+			paths = append(paths, path.Join(sdRoot+"/", f))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import "os"
+
+// processExists checks whether a process with the given PID is running.
+// FindProcess fails on Windows if there is none.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Units for displaying transfer rates
+const (
+	rateUnitAuto = "auto"
+	rateUnitKiB  = "KiB"
+	rateUnitMiB  = "MiB"
+)
+
+// formatRate formats the rate of transferring size bytes in duration
+// using -rateUnit and -rateDecimals. The auto unit switches to MiB/s
+// from 1 MiB/s on.
+func (o *options) formatRate(size uint64, duration time.Duration) string {
+	rate := float64(size) / duration.Seconds() / 1024
+	unit := o.rateUnit
+	if unit == rateUnitAuto {
+		unit = rateUnitKiB
+		if rate >= 1024 {
+			unit = rateUnitMiB
+		}
+	}
+	if unit == rateUnitMiB {
+		rate /= 1024
+	}
+	return strconv.FormatFloat(rate, 'f', o.rateDecimals, 64) + " " + unit + "/s"
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing a number of events per second
+// with bursts of up to one second's worth of events.
+// A nil rateLimiter does not limit anything.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// requestLimiter limits the requests sent to the Duet
+var requestLimiter *rateLimiter
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{rate: perSecond, tokens: 1, last: time.Now()}
+}
+
+// burst returns the maximum number of tokens the bucket can hold
+func (l *rateLimiter) burst() float64 {
+	if l.rate < 1 {
+		return 1
+	}
+	return l.rate
+}
+
+// Wait blocks until the next event is allowed
+func (l *rateLimiter) Wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		time.Sleep(wait)
+		l.last = time.Now()
+		l.tokens = 0
+		return
+	}
+	l.tokens--
+}
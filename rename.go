@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// renameRule maps remote paths starting with remote to local paths
+// starting with local (relative to outDir)
+type renameRule struct {
+	remote string
+	local  string
+}
+
+// renameMap is a list of rename rules sorted by descending length of
+// their remote prefix so the most specific rule is found first
+type renameMap []renameRule
+
+// loadRenameMap reads rules in the form remotePrefix=localPrefix from
+// the given file, one per line. Empty lines and lines starting with #
+// are ignored.
+func loadRenameMap(path string) (renameMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rm renameMap
+	s := bufio.NewScanner(f)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected remotePrefix=localPrefix", path, lineNo)
+		}
+		local := filepath.Clean(filepath.FromSlash(strings.TrimSpace(parts[1])))
+		if filepath.IsAbs(local) || strings.HasPrefix(local, string(filepath.Separator)) || local == "." || local == ".." || strings.HasPrefix(local, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s:%d: localPrefix must be a relative path below outDir", path, lineNo)
+		}
+		rm = append(rm, renameRule{
+			remote: cleanPath(strings.TrimSpace(parts[0])),
+			local:  filepath.ToSlash(local),
+		})
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(rm, func(i, j int) bool {
+		return len(rm[i].remote) > len(rm[j].remote)
+	})
+	return rm, nil
+}
+
+// LocalPath returns the path relative to outDir for the given remote
+// path if any rule matches it
+func (rm renameMap) LocalPath(remotePath string) (string, bool) {
+	for _, r := range rm {
+		if remotePath != r.remote && !strings.HasPrefix(remotePath, r.remote+"/") {
+			continue
+		}
+		return filepath.FromSlash(r.local + strings.TrimPrefix(remotePath, r.remote)), true
+	}
+	return "", false
+}
+
+// RemotePath is the inverse of LocalPath and returns the remote path for
+// the given path relative to outDir if it is covered by a rule. If the
+// local prefixes of several rules match the longest one wins.
+func (rm renameMap) RemotePath(localPath string) (string, bool) {
+	localPath = filepath.ToSlash(localPath)
+	var match *renameRule
+	for i, r := range rm {
+		if localPath != r.local && !strings.HasPrefix(localPath, r.local+"/") {
+			continue
+		}
+		if match == nil || len(r.local) > len(match.local) {
+			match = &rm[i]
+		}
+	}
+	if match == nil {
+		return "", false
+	}
+	return match.remote + strings.TrimPrefix(localPath, match.local), true
+}
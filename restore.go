@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	restoreScriptSh  = "restore.sh"
+	restoreScriptPs1 = "restore.ps1"
+
+	// passwordEnv is read by the restore scripts for the password
+	passwordEnv = "DUET_PASSWORD"
+)
+
+// walkBackup calls fn for every file of the backup in outDir with its
+// remote path and its original content, i.e. undoing the transformations
+// applied when it was stored. Once the manifest is complete only files
+// known from it are part of the backup. Files with redacted lines are
+// skipped.
+// Files stored elsewhere below the root of the backup due to rename rules
+// are mapped back to their remote paths.
+func walkBackup(dirToBackup, outDir string, o *options, fn func(remotePath string, content []byte, fi os.FileInfo) error) error {
+	root := outDir
+	if len(o.renames) > 0 {
+		root = o.outRoot
+	}
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if o.isProtected(path) {
+			return nil
+		}
+		if fi.IsDir() {
+			// Directories not created by us were not part of the backup
+			if path != root && !isManagedDirectory(filepath.Dir(path), fi) && !o.leadsToBackup(path, outDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isOwnFile(fi.Name()) || !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		remotePath, ok := o.renamedRemotePath(path)
+		if !ok {
+			rel, err := filepath.Rel(outDir, path)
+			if err != nil {
+				return err
+			}
+			// Not part of the backup of dirToBackup
+			if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil
+			}
+			remotePath = dirToBackup + "/" + filepath.ToSlash(rel)
+		}
+
+		e, ok := o.m.Files[strings.TrimSuffix(remotePath, compressedSuffix)]
+		if ok && e.Compressed {
+			remotePath = strings.TrimSuffix(remotePath, compressedSuffix)
+		} else if e, ok = o.m.Files[remotePath+compressedSuffix]; ok && e.Decompressed {
+			remotePath += compressedSuffix
+		} else {
+			e, ok = o.m.Files[remotePath]
+		}
+
+		if !ok {
+			// Incomplete downloads and files being written atomically
+			// were never part of the backup
+			if isPartialFile(fi.Name()) || strings.HasSuffix(fi.Name(), ".tmp") {
+				return nil
+			}
+			// Only files downloaded from the Duet are restored but
+			// without a complete manifest this cannot be told
+			if o.m.Complete {
+				o.info("  Skipping", path, "since it is not part of the backup")
+				return nil
+			}
+			e = &manifestEntry{}
+		}
+		if e.Redacted {
+			log.Println("  Skipping redacted file", remotePath)
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if e.Compressed {
+			if content, err = gunzipContent(content); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+		}
+		if e.LineEndings == lineEndingsCRLF {
+			content = restoreLineEndings(content)
+		}
+		if e.Decompressed {
+			if content, err = gzipContent(content); err != nil {
+				return err
+			}
+		}
+		return fn(remotePath, content, fi)
+	})
+}
+
+// leadsToBackup checks whether dir is outDir, the target of a rename rule
+// or one of their parents, which are created without a marker file
+func (o *options) leadsToBackup(dir, outDir string) bool {
+	targets := []string{outDir}
+	for _, r := range o.renames {
+		targets = append(targets, filepath.Join(o.outRoot, filepath.FromSlash(r.local)))
+	}
+	for _, t := range targets {
+		if t == dir || strings.HasPrefix(t, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreTree uploads all files of the backup in outDir to dirToBackup
+func restoreTree(address, dirToBackup, outDir string, o *options) error {
+	return walkBackup(dirToBackup, outDir, o, func(remotePath string, content []byte, fi os.FileInfo) error {
+		if o.verbose {
+			log.Println("  Uploading: ", remotePath)
+		}
+
+		// Older firmware might reject the modification time so stop
+		// sending it once a request is refused because of it. Other
+		// errors like timeouts or a full SD card say nothing about it.
+		var date time.Time
+		if !o.noUploadTime {
+			date = fi.ModTime()
+		}
+		err := upload(address, remotePath, content, date)
+		if re, ok := err.(*responseError); ok && re.status == http.StatusBadRequest && !date.IsZero() {
+			log.Println("  Upload with modification time was rejected, retrying without it:", err)
+			o.noUploadTime = true
+			err = upload(address, remotePath, content, time.Time{})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", remotePath, err)
+		}
+		o.stats.added++
+		return nil
+	})
+}
+
+// restorePreview counts the results of a restore dry-run
+type restorePreview struct {
+	added, changed, newer, unchanged int
+}
+
+// previewRestore compares the backup in outDir with the remote tree and
+// writes one line for every file that a restore would create or change
+// without uploading anything. Files that are newer on the Duet than in
+// the backup are reported separately since a restore would revert them.
+func previewRestore(w io.Writer, address, dirToBackup, outDir string, o *options, p *restorePreview) error {
+	fl, err := listTree(address, dirToBackup, o)
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]file)
+	flattenTree(fl, remote)
+
+	return walkBackup(dirToBackup, outDir, o, func(remotePath string, content []byte, fi os.FileInfo) error {
+		f, ok := remote[remotePath]
+		e, known := o.m.Files[remotePath]
+		localDate := fi.ModTime().Format("2006-01-02 15:04:05")
+		remoteDate := f.Date.Time.Format("2006-01-02 15:04:05")
+		switch {
+		case !ok:
+			p.added++
+			fmt.Fprintln(w, "new:      ", remotePath)
+		case f.Date.Time.Unix() > fi.ModTime().Unix():
+			p.newer++
+			fmt.Fprintf(w, "newer:     %s (local %s, remote %s)\n", remotePath, localDate, remoteDate)
+		case uint64(f.Size) != uint64(len(content)) && !(known && e.Decompressed):
+			p.changed++
+			fmt.Fprintf(w, "size:      %s (local %d, remote %d)\n", remotePath, len(content), f.Size)
+		case f.Date.Time.Unix() != fi.ModTime().Unix():
+			p.changed++
+			fmt.Fprintf(w, "date:      %s (local %s, remote %s)\n", remotePath, localDate, remoteDate)
+		default:
+			p.unchanged++
+		}
+		return nil
+	})
+}
+
+// flattenTree adds all files of the tree to files by their remote path
+func flattenTree(fl *filelist, files map[string]file) {
+	for _, f := range fl.Files {
+		if f.Type != typeDirectory {
+			files[fl.Dir+"/"+f.Name] = f
+		}
+	}
+	for _, sub := range fl.Subdirs {
+		flattenTree(sub, files)
+	}
+}
+
+// gunzipContent decompresses gzipped content
+func gunzipContent(content []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// writeRestoreScripts writes a shell and a PowerShell script to outDir
+// that run duetbackup with the given arguments to restore the backup.
+// The password is taken from the environment if usePassword is set.
+func writeRestoreScripts(outDir string, args []string, usePassword bool) error {
+	var sh, ps1 strings.Builder
+	sh.WriteString("#!/bin/sh\n# Restores this backup to the Duet it was taken from\n")
+	ps1.WriteString("# Restores this backup to the Duet it was taken from\n")
+	if usePassword {
+		sh.WriteString("# Set " + passwordEnv + " to the password of the Duet before running it\n")
+		ps1.WriteString("# Set $env:" + passwordEnv + " to the password of the Duet before running it\n")
+	}
+
+	sh.WriteString("exec duetbackup")
+	ps1.WriteString("& duetbackup")
+	for _, arg := range args {
+		sh.WriteString(" " + shellQuote(arg))
+		ps1.WriteString(" " + powerShellQuote(arg))
+	}
+	if usePassword {
+		sh.WriteString(` -password "$` + passwordEnv + `"`)
+		ps1.WriteString(" -password $env:" + passwordEnv)
+	}
+	sh.WriteString("\n")
+	ps1.WriteString("\nexit $LASTEXITCODE\n")
+
+	if err := ioutil.WriteFile(filepath.Join(outDir, restoreScriptSh), []byte(sh.String()), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outDir, restoreScriptPs1), []byte(ps1.String()), 0644)
+}
+
+// safeArg matches arguments that do not need quoting
+var safeArg = regexp.MustCompile(`^[A-Za-z0-9_./:=@,+-]+$`)
+
+// shellQuote quotes s for a POSIX shell if necessary
+func shellQuote(s string) string {
+	if safeArg.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// powerShellQuote quotes s for PowerShell if necessary
+func powerShellQuote(s string) string {
+	if safeArg.MatchString(s) && !strings.HasPrefix(s, "@") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWalkBackup(t *testing.T) {
+	outDir, remove := tempDir(t)
+	defer remove()
+
+	files := map[string]string{
+		"config.g":                "G28\n",
+		"crlf.g":                  "M117 a\nM117 b\n",
+		"redacted.g":              "; redacted by duetbackup\n",
+		"job.tmp":                 "G1 X10\n",
+		"stray.txt":               "not from the Duet\n",
+		"big.bin" + partialSuffix: "incomplete",
+		"big.bin" + partialSuffix + partialInfoSuffix: "{}",
+		manifestFile + ".tmp":                         "{}",
+		manifestFile:                                  "{}",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(outDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		complete bool
+		want     map[string]string
+	}{
+		{true, map[string]string{
+			"0:/sys/config.g": "G28\n",
+			"0:/sys/crlf.g":   "M117 a\r\nM117 b\r\n",
+			"0:/sys/job.tmp":  "G1 X10\n",
+		}},
+		// Unknown files might be part of a backup made before the
+		// manifest existed
+		{false, map[string]string{
+			"0:/sys/config.g":  "G28\n",
+			"0:/sys/crlf.g":    "M117 a\r\nM117 b\r\n",
+			"0:/sys/job.tmp":   "G1 X10\n",
+			"0:/sys/stray.txt": "not from the Duet\n",
+		}},
+	}
+	for _, tt := range tests {
+		o := testOptions(outDir)
+		o.m.Complete = tt.complete
+		o.m.entry("0:/sys/config.g")
+		o.m.entry("0:/sys/crlf.g").LineEndings = lineEndingsCRLF
+		o.m.entry("0:/sys/redacted.g").Redacted = true
+		o.m.entry("0:/sys/job.tmp")
+
+		restored := make(map[string]string)
+		err := walkBackup(sysDir, outDir, o, func(remotePath string, content []byte, fi os.FileInfo) error {
+			restored[remotePath] = string(content)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(restored) != len(tt.want) {
+			var got []string
+			for p := range restored {
+				got = append(got, p)
+			}
+			sort.Strings(got)
+			t.Errorf("complete %v: got %s, want only %d files", tt.complete, strings.Join(got, ", "), len(tt.want))
+			continue
+		}
+		for p, content := range tt.want {
+			if restored[p] != content {
+				t.Errorf("complete %v: %s: got %q, want %q", tt.complete, p, restored[p], content)
+			}
+		}
+	}
+}
+
+func TestRestoreLineEndings(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"G28", "G28"},
+		{"G28\n", "G28\r\n"},
+		{"\nG28\nM84\n", "\r\nG28\r\nM84\r\n"},
+		{"G28\r\nM84\n", "G28\r\nM84\r\n"},
+		{"G28\r\n", "G28\r\n"},
+		{"\n\n", "\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(restoreLineEndings([]byte(tt.in))); got != tt.want {
+			t.Errorf("restoreLineEndings(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRestoreTreeUploadTime(t *testing.T) {
+	outDir, remove := tempDir(t)
+	defer remove()
+	for _, name := range []string{"config.g", "homeall.g"} {
+		if err := ioutil.WriteFile(filepath.Join(outDir, name), []byte("G28\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Failures unrelated to the modification time keep sending it
+	d := newFakeDuet(nil)
+	defer d.close()
+	d.uploadErr = 1
+	o := testOptions(outDir)
+	if err := restoreTree(d.URL(), sysDir, outDir, o); err == nil {
+		t.Error("restore succeeded although the uploads failed")
+	}
+	if o.noUploadTime {
+		t.Error("modification time disabled after a failed upload")
+	}
+
+	// A rejected modification time is not sent anymore
+	d.uploadErr = 0
+	d.rejectTime = true
+	if err := restoreTree(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+	if !o.noUploadTime || o.stats.added != 2 {
+		t.Errorf("got %d uploaded files with noUploadTime %v, want 2 and true", o.stats.added, o.noUploadTime)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// partialInfoSuffix is appended to the name of a partial download for
+// the file describing which remote file it belongs to
+const partialInfoSuffix = ".info"
+
+// partialInfo identifies the remote file a partial download belongs to.
+// ETag and LastModified are the validators sent by the Duet, if any.
+type partialInfo struct {
+	RemoteDate   time.Time `json:"remoteDate"`
+	Size         uint64    `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+}
+
+// isPartialFile checks whether the local file belongs to an unfinished
+// download
+func isPartialFile(name string) bool {
+	return strings.HasSuffix(name, partialSuffix) || strings.HasSuffix(name, partialSuffix+partialInfoSuffix)
+}
+
+// removePartial removes a partial download and its info
+func removePartial(tmp string) {
+	os.Remove(tmp)
+	os.Remove(tmp + partialInfoSuffix)
+}
+
+// prepareResume adds a Range header to req to continue the partial
+// download in tmp if it belongs to the same version of the remote file.
+// The stored validator is sent as If-Range so the Duet sends the whole
+// file if it changed nonetheless. It returns the offset to continue at.
+func prepareResume(req *http.Request, tmp string, file file) int64 {
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return 0
+	}
+	var info partialInfo
+	b, err := ioutil.ReadFile(tmp + partialInfoSuffix)
+	if err == nil {
+		err = json.Unmarshal(b, &info)
+	}
+	if err != nil || !info.RemoteDate.Equal(file.Date.Time) || info.Size != uint64(file.Size) ||
+		fi.Size() == 0 || uint64(fi.Size()) >= uint64(file.Size) {
+		removePartial(tmp)
+		return 0
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", fi.Size()))
+	if info.ETag != "" {
+		req.Header.Set("If-Range", info.ETag)
+	} else if info.LastModified != "" {
+		req.Header.Set("If-Range", info.LastModified)
+	}
+	return fi.Size()
+}
+
+// openPartial opens the file to write the response to. For partial
+// content the existing data is passed to h and the file is positioned
+// at its end. Otherwise the file is created from scratch and, if resume
+// is set, the information needed to continue it later is stored.
+func openPartial(tmp string, resp *http.Response, offset int64, file file, h hash.Hash, resume bool) (*os.File, error) {
+	if resp.StatusCode == http.StatusPartialContent {
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			removePartial(tmp)
+			return nil, fmt.Errorf("unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(h, f); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	f, err := os.Create(tmp)
+	if err != nil || !resume {
+		return f, err
+	}
+	b, err := json.Marshal(partialInfo{
+		RemoteDate:   file.Date.Time,
+		Size:         uint64(file.Size),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	if err == nil {
+		err = ioutil.WriteFile(tmp+partialInfoSuffix, b, 0644)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
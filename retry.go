@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// retryDelay is multiplied by the attempt number before retrying
+const retryDelay = time.Second
+
+var errRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// retryPolicy controls how often failed requests are repeated
+type retryPolicy struct {
+	// perRequest is the number of retries for a single request
+	perRequest int
+
+	// budget is the number of retries left for the whole run.
+	// A negative value means unlimited.
+	budget int
+}
+
+var retries = retryPolicy{budget: -1}
+
+// withRetries calls fn until it succeeds, the retries for this request
+// are used up or the budget of the run is exhausted
+func withRetries(what string, fn func() error) error {
+	err := fn()
+	for attempt := 1; err != nil && attempt <= retries.perRequest; attempt++ {
+		if retries.budget == 0 {
+			return errRetryBudgetExhausted
+		}
+		if retries.budget > 0 {
+			retries.budget--
+		}
+		log.Printf("  Retrying %s (%d/%d) after error: %s", what, attempt, retries.perRequest, err)
+		time.Sleep(time.Duration(attempt) * retryDelay)
+		err = fn()
+	}
+	return err
+}
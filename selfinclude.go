@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dsfSDDir is where DSF on an SBC keeps the files of the virtual SD card
+const dsfSDDir = "/opt/dsf/sd"
+
+// checkSelfInclusion refuses an outDir that is part of the local directory
+// the Duet serves dirToBackup from, which is the case when running on the
+// SBC of a Duet 3 and backing up into its own SD card directory. Every run
+// would then back up the previous backup as well.
+func checkSelfInclusion(dirToBackup, outDir string) error {
+	if _, err := os.Stat(dsfSDDir); err != nil {
+		return nil
+	}
+	dir := dirToBackup
+	if i := strings.Index(dir, ":"); i >= 0 {
+		if dir[:i] != "0" {
+			return nil
+		}
+		dir = dir[i+1:]
+	}
+	source := resolvePath(filepath.Join(dsfSDDir, filepath.FromSlash(dir)))
+	out := resolvePath(outDir)
+	if rel, err := filepath.Rel(source, out); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is inside %s which is served as %s by this machine, the backup would include itself", outDir, source, dirToBackup)
+	}
+	return nil
+}
+
+// resolvePath makes path absolute and resolves symlinks of its longest
+// existing part
+func resolvePath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	for p, rest := path, ""; ; {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(resolved, rest)
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return path
+		}
+		p, rest = parent, filepath.Join(filepath.Base(p), rest)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// volumeChanges returns the change counters of all volumes of the Duet
+// and the time it was started. The counters are reset on every start of
+// the Duet so they are only comparable while it keeps running.
+func volumeChanges(address string, o *options) ([]int, time.Time, error) {
+	var seqs struct {
+		VolChanges []int `json:"volChanges"`
+	}
+	if err := queryModel(address, "seqs", o.listTimeout, &seqs); err != nil {
+		return nil, time.Time{}, err
+	}
+	if seqs.VolChanges == nil {
+		return nil, time.Time{}, errors.New("the firmware does not report volume changes")
+	}
+	var upTime float64
+	if err := queryModel(address, "state.upTime", o.listTimeout, &upTime); err != nil {
+		return nil, time.Time{}, err
+	}
+	return seqs.VolChanges, time.Now().Add(-time.Duration(upTime * float64(time.Second))), nil
+}
+
+// unchangedSince checks whether the volume change counters are still the
+// ones recorded by the last successful run and the Duet has not been
+// restarted since then
+func (m *manifest) unchangedSince(volChanges []int, started time.Time) bool {
+	if m.LastSuccess.IsZero() || !started.Before(m.LastSuccess) || len(volChanges) != len(m.VolChanges) {
+		return false
+	}
+	for i := range volChanges {
+		if volChanges[i] != m.VolChanges[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+const (
+	// defaultStreamThreshold is the size in bytes above which files are
+	// written to disk while downloading instead of being kept in memory
+	defaultStreamThreshold = 8 << 20
+
+	// partialSuffix is appended to files while they are streamed
+	partialSuffix = ".part"
+)
+
+// streamable checks whether the file can be written while downloading.
+// Line ending normalization, redaction, decompression and validation
+// need the whole content and named pipes and devices cannot be replaced.
+func (o *options) streamable(file file, fi os.FileInfo) bool {
+	return uint64(file.Size) > o.streamThreshold &&
+		!o.normalizeExts.Matches(file.Name) &&
+		len(o.redact) == 0 &&
+		!o.decompresses(file.Name) &&
+		!o.validated(file.Name) &&
+		(fi == nil || fi.Mode().IsRegular())
+}
+
+// streamFile downloads a remote file directly into a temporary file next
+// to fileName that replaces it once the download is complete. With
+// -resume an incomplete temporary file is kept and continued by the next
+// attempt, unless files are stored compressed.
+func streamFile(baseURL, remoteFilename, fileName string, file file, fi os.FileInfo, o *options) error {
+	tmp := fileName + partialSuffix
+	resume := o.resume && !o.storeCompressed
+	var written, offset int64
+	var sum string
+	var resumed bool
+	prepare := func(req *http.Request) error {
+		offset = 0
+		if resume {
+			offset = prepareResume(req, tmp, file)
+		}
+		return nil
+	}
+	duration, err := downloadWith(downloadRequestURL(baseURL, remoteFilename), o.fileTimeout(file.Size), prepare, func(resp *http.Response) error {
+		h := sha256.New()
+		r := io.TeeReader(resp.Body, h)
+		f, err := openPartial(tmp, resp, offset, file, h, resume)
+		if err != nil {
+			return err
+		}
+		resumed = resp.StatusCode == http.StatusPartialContent
+		var w io.Writer = f
+		var zw *gzip.Writer
+		if o.storeCompressed {
+			zw = gzip.NewWriter(f)
+			w = zw
+		}
+		written, err = io.Copy(w, r)
+		if err == nil && zw != nil {
+			err = zw.Close()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+		return err
+	})
+	if err != nil {
+		if !resume {
+			os.Remove(tmp)
+		}
+		return err
+	}
+	if resumed && o.verbose {
+		log.Println("  Resumed:   ", remoteFilename, "at", offset, "bytes")
+	}
+	os.Remove(tmp + partialInfoSuffix)
+	if err = makeWritable(fileName, fi); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, fileName); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = o.timing.Record(remoteFilename, int(written), *duration); err != nil {
+		return err
+	}
+
+	e := o.m.entry(remoteFilename)
+	e.SHA256 = sum
+	e.LineEndings = ""
+	e.Redacted = false
+	e.Compressed = o.storeCompressed
+	e.Decompressed = false
+
+	o.countTransfer(remoteFilename, fi, uint64(written), *duration)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"time"
+)
+
+// timingLog writes the duration of every download as CSV.
+// All methods can be called on a nil timingLog in which case they do nothing.
+type timingLog struct {
+	f *os.File
+	w *csv.Writer
+}
+
+// openTimingLog creates the CSV file and writes its header
+func openTimingLog(path string) (*timingLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &timingLog{f: f, w: csv.NewWriter(f)}
+	if err = t.w.Write([]string{"path", "bytes", "durationMs", "rateKiBs"}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Record adds a line for a downloaded file
+func (t *timingLog) Record(remotePath string, bytes int, duration time.Duration) error {
+	if t == nil {
+		return nil
+	}
+	var rate float64
+	if duration > 0 {
+		rate = float64(bytes) / duration.Seconds() / 1024
+	}
+	return t.w.Write([]string{
+		remotePath,
+		strconv.Itoa(bytes),
+		strconv.FormatFloat(duration.Seconds()*1000, 'f', 3, 64),
+		strconv.FormatFloat(rate, 'f', 1, 64),
+	})
+}
+
+// Close flushes all records and closes the file
+func (t *timingLog) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.w.Flush()
+	err := t.w.Error()
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
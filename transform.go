@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	lineEndingsCRLF  = "crlf"
+	compressedSuffix = ".gz"
+
+	// redactedLine replaces lines matching a redact pattern. It is a
+	// G-code comment so the file stays valid.
+	redactedLine = "; redacted by duetbackup"
+)
+
+// extensions is a set of lower-case file extensions including the dot
+type extensions map[string]struct{}
+
+// parseExtensions creates a set of extensions from a comma-separated list
+func parseExtensions(list string) extensions {
+	exts := make(extensions)
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts[ext] = struct{}{}
+	}
+	return exts
+}
+
+// Matches checks if the extension of the given file name is in the set
+func (e extensions) Matches(name string) bool {
+	_, ok := e[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+// isBinary uses the presence of a NUL byte as a hint for binary content
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// normalizeLineEndings converts CRLF line endings of text content to LF.
+// It reports whether anything was changed.
+func normalizeLineEndings(content []byte) ([]byte, bool) {
+	if isBinary(content) || !bytes.Contains(content, []byte("\r\n")) {
+		return content, false
+	}
+	return bytes.Replace(content, []byte("\r\n"), []byte("\n"), -1), true
+}
+
+// restoreLineEndings converts LF line endings back to CRLF. Line endings
+// that already are CRLF, e.g. after editing the backup, are kept as is.
+func restoreLineEndings(content []byte) []byte {
+	n := bytes.Count(content, []byte("\n")) - bytes.Count(content, []byte("\r\n"))
+	if n == 0 {
+		return content
+	}
+	restored := make([]byte, 0, len(content)+n)
+	for i, b := range content {
+		if b == '\n' && (i == 0 || content[i-1] != '\r') {
+			restored = append(restored, '\r')
+		}
+		restored = append(restored, b)
+	}
+	return restored
+}
+
+// decompresses checks whether a remote file is stored decompressed
+func (o *options) decompresses(name string) bool {
+	return o.decompressGz && len(name) > len(compressedSuffix) && strings.HasSuffix(name, compressedSuffix)
+}
+
+// shadowsRemoteFile checks whether a file would be stored decompressed
+// under the name of another file of the same remote directory
+func (o *options) shadowsRemoteFile(fl *filelist, name string) bool {
+	return o.decompresses(name) && fl.hasFile(strings.TrimSuffix(name, compressedSuffix))
+}
+
+// gzipContent compresses the given content with gzip
+func gzipContent(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// redactPatterns is a list of regular expressions selecting lines
+// that must not be stored
+type redactPatterns []*regexp.Regexp
+
+func (r *redactPatterns) String() string {
+	if r == nil {
+		return ""
+	}
+	exprs := make([]string, 0, len(*r))
+	for _, re := range *r {
+		exprs = append(exprs, re.String())
+	}
+	return strings.Join(exprs, ",")
+}
+
+func (r *redactPatterns) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, re)
+	return nil
+}
+
+// redactLines replaces every line of text content matching one of the
+// patterns by a placeholder keeping its line ending. It returns the
+// number of replaced lines.
+func redactLines(content []byte, patterns redactPatterns) ([]byte, int) {
+	if len(patterns) == 0 || isBinary(content) {
+		return content, 0
+	}
+	lines := bytes.Split(content, []byte("\n"))
+	redacted := 0
+	for i, line := range lines {
+		text := bytes.TrimSuffix(line, []byte("\r"))
+		for _, re := range patterns {
+			if re.Match(text) {
+				lines[i] = append([]byte(redactedLine), line[len(text):]...)
+				redacted++
+				break
+			}
+		}
+	}
+	if redacted == 0 {
+		return content, 0
+	}
+	return bytes.Join(lines, []byte("\n")), redacted
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// headerTransport sets additional headers like the User-Agent on every
+// request before handing it to the wrapped transport
+type headerTransport struct {
+	header http.Header
+	next   http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the original request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+len(t.header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	for k, v := range t.header {
+		r.Header[k] = v
+	}
+	return t.next.RoundTrip(r)
+}
+
+// reuseCountingTransport counts how many requests were sent over an
+// already established connection
+type reuseCountingTransport struct {
+	next     http.RoundTripper
+	requests uint64
+	reused   uint64
+}
+
+func (t *reuseCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddUint64(&t.requests, 1)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddUint64(&t.reused, 1)
+			}
+		},
+	}
+	return t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+// String summarizes the connection reuse
+func (t *reuseCountingTransport) String() string {
+	return fmt.Sprintf("%d of %d requests reused an existing connection", atomic.LoadUint64(&t.reused), atomic.LoadUint64(&t.requests))
+}
+
+// debugTransport logs every request with the status and size of its
+// response. If dumpDir is set the response bodies are written to files
+// in it, numbered in the order of the requests.
+type debugTransport struct {
+	next     http.RoundTripper
+	dumpDir  string
+	requests uint64
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := atomic.AddUint64(&t.requests, 1)
+	u := redactedURL(req.URL)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		log.Printf("HTTP #%d %s %s: %s", n, req.Method, u, err)
+		return resp, err
+	}
+
+	body := &debugBody{ReadCloser: resp.Body, n: n, request: req.Method + " " + u, status: resp.Status, start: start}
+	if t.dumpDir != "" {
+		name := filepath.Join(t.dumpDir, fmt.Sprintf("%04d%s", n, dumpSuffix(req.URL.Path)))
+		if body.dump, err = os.Create(name); err != nil {
+			log.Printf("HTTP #%d failed to dump body: %s", n, err)
+		}
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// debugBody counts the bytes read from a response body and logs the
+// response once it is closed
+type debugBody struct {
+	io.ReadCloser
+	n               uint64
+	request, status string
+	start           time.Time
+	size            int64
+	dump            *os.File
+}
+
+func (b *debugBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if b.dump != nil && n > 0 {
+		b.dump.Write(p[:n])
+	}
+	return n, err
+}
+
+func (b *debugBody) Close() error {
+	if b.dump != nil {
+		b.dump.Close()
+		b.dump = nil
+	}
+	log.Printf("HTTP #%d %s: %s, %d bytes read in %s", b.n, b.request, b.status, b.size, time.Since(b.start).Round(time.Millisecond))
+	return b.ReadCloser.Close()
+}
+
+// redactedURL returns the URL without the value of a password parameter
+func redactedURL(u *url.URL) string {
+	q := u.Query()
+	if _, ok := q["password"]; !ok {
+		return u.String()
+	}
+	q.Set("password", "***")
+	r := *u
+	r.RawQuery = q.Encode()
+	return r.String()
+}
+
+// dumpSuffix turns the path of a request into a file name suffix
+func dumpSuffix(urlPath string) string {
+	return "-" + strings.Trim(strings.Map(func(r rune) rune {
+		if r == '/' || r == ':' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, urlPath), "_")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// gcodeExtension selects the files checked by -validateConfig
+const gcodeExtension = ".g"
+
+// maxValidationProblems limits the number of problems reported per file
+const maxValidationProblems = 5
+
+// validateGcode applies simple lexical checks to a G-code file to find
+// files that were truncated or corrupted while downloading. It returns a
+// description of every problem found.
+func validateGcode(content []byte, expectedSize uint64) []string {
+	var problems []string
+	if uint64(len(content)) != expectedSize {
+		problems = append(problems, fmt.Sprintf("received %d bytes but the Duet reported %d", len(content), expectedSize))
+	}
+	if bytes.IndexByte(content, 0) >= 0 {
+		problems = append(problems, "contains NUL bytes")
+	}
+
+	lines := bytes.Split(content, []byte("\n"))
+	for i, line := range lines {
+		if unbalancedQuotes(line) {
+			problems = append(problems, fmt.Sprintf("unbalanced quotes in line %d", i+1))
+			if len(problems) >= maxValidationProblems {
+				break
+			}
+		}
+	}
+
+	// An unterminated last line that is not a comment is likely cut off
+	if last := bytes.TrimSpace(lines[len(lines)-1]); len(last) > 0 && last[0] != ';' && len(problems) > 0 {
+		problems = append(problems, "last line is not terminated, the file might be truncated")
+	}
+	return problems
+}
+
+// unbalancedQuotes checks whether a string in the line is not closed.
+// Quotes in comments are ignored and a doubled quote inside a string is
+// an escaped quote that does not end it.
+func unbalancedQuotes(line []byte) bool {
+	inString := false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			inString = !inString
+		case c == ';' && !inString:
+			return false
+		}
+	}
+	return inString
+}
+
+// validated reports whether -validateConfig applies to the file
+func (o *options) validated(name string) bool {
+	return o.validateConfig && strings.ToLower(path.Ext(name)) == gcodeExtension
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// verifyResult counts the findings of verifyTree
+type verifyResult struct {
+	ok         int
+	missing    int
+	mismatched int
+	extra      int
+	unhashed   int
+
+	// sizeOnly counts files that differ only in size, which a sync would
+	// not update since it decides by date
+	sizeOnly int
+}
+
+// valid reports whether the local backup matches the remote listing.
+// Extra local files are only relevant if they would be removed.
+func (r *verifyResult) valid(removeLocal bool) bool {
+	return r.missing == 0 && r.mismatched == 0 && (r.extra == 0 || !removeLocal)
+}
+
+// verifyTree compares the remote tree fl with the local files in outDir
+// and writes one line for every difference to w. Nothing is changed.
+func verifyTree(w io.Writer, fl *filelist, outDir string, o *options, r *verifyResult) error {
+	subdirs := make(map[string]*filelist)
+	for _, sub := range fl.Subdirs {
+		subdirs[sub.Dir] = sub
+	}
+
+	for _, f := range fl.Files {
+		remotePath := fl.Dir + "/" + f.Name
+		if o.excls.Contains(remotePath) || o.ignored(remotePath) || o.shadowsRemoteFile(fl, f.Name) {
+			continue
+		}
+
+		if f.Type == typeDirectory {
+			if sub, ok := subdirs[remotePath]; ok {
+				if err := verifyTree(w, sub, o.localPath(remotePath, filepath.Join(outDir, f.Name)), o, r); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		fileName := o.localName(o.localPath(remotePath, filepath.Join(outDir, f.Name)))
+		fi, err := os.Stat(fileName)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			r.missing++
+			fmt.Fprintln(w, "missing:  ", remotePath)
+			continue
+		}
+
+		// Transformed files cannot be compared by size
+		sizeComparable := !o.storeCompressed
+		if e, ok := o.m.Files[remotePath]; ok && (e.LineEndings != "" || e.Compressed || e.Decompressed || e.Redacted) {
+			sizeComparable = false
+		}
+		switch {
+		case o.outdated(remotePath, f.Date.Time, fi):
+			r.mismatched++
+			fmt.Fprintf(w, "date:      %s (local %s, remote %s)\n", remotePath, fi.ModTime().Format("2006-01-02 15:04:05"), f.Date.Time.Format("2006-01-02 15:04:05"))
+		case sizeComparable && uint64(fi.Size()) != uint64(f.Size):
+			r.sizeOnly++
+			fmt.Fprintf(w, "size:      %s (local %d, remote %d, not updated by a sync)\n", remotePath, fi.Size(), f.Size)
+		default:
+			r.ok++
+		}
+	}
+
+	// Report local files that do not exist on the Duet and that a run
+	// with -removeLocal would remove
+	files, err := ioutil.ReadDir(outDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	expected := o.localNames(fl, outDir)
+	for _, f := range files {
+		if _, ok := expected[f.Name()]; ok {
+			continue
+		}
+		if kept, _ := o.keptLocally(fl, outDir, f); kept {
+			continue
+		}
+		r.extra++
+		fmt.Fprintln(w, "extra:    ", filepath.Join(outDir, f.Name()))
+	}
+	return nil
+}
+
+// verifyLocalHashes hashes the original content of every file of the
+// backup in outDir and compares it with the hash in the manifest. It
+// writes one line for every file that differs or has no known hash.
+func verifyLocalHashes(w io.Writer, dirToBackup, outDir string, o *options, r *verifyResult) error {
+	return walkBackup(dirToBackup, outDir, o, func(remotePath string, content []byte, fi os.FileInfo) error {
+		e, ok := o.m.Files[remotePath]
+		switch {
+		case !ok || e.SHA256 == "":
+			r.unhashed++
+			fmt.Fprintln(w, "unhashed: ", remotePath)
+		case e.Decompressed:
+			// Compressing again does not reproduce the original bytes
+			r.unhashed++
+			fmt.Fprintln(w, "unhashed: ", remotePath, "(stored decompressed)")
+		case sha256Hex(content) != e.SHA256:
+			r.mismatched++
+			fmt.Fprintln(w, "corrupt:  ", remotePath)
+		default:
+			r.ok++
+		}
+		return nil
+	})
+}
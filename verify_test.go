@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyTreeExtraFiles(t *testing.T) {
+	d := newFakeDuet(map[string]string{
+		"0:/sys/config.g":   "G28\n",
+		"0:/sys/macros/a.g": "M117 a\n",
+	})
+	defer d.close()
+
+	outDir, remove := tempDir(t)
+	defer remove()
+	if err := syncFolder(d.URL(), sysDir, outDir, testOptions(outDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the managed directory gone would be removed by a run with
+	// -removeLocal
+	if err := ensureOutDirExists(filepath.Join(outDir, "gone"), testOptions(outDir)); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"notes.txt", filepath.Join("macros", "big.bin"+partialSuffix)} {
+		if err := ioutil.WriteFile(filepath.Join(outDir, name), []byte("local"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(outDir, "unmanaged"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	o := testOptions(outDir)
+	o.resume = true
+	if err := o.keepLocal.Set("*.txt"); err != nil {
+		t.Fatal(err)
+	}
+	fl, err := listTree(d.URL(), sysDir, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	var res verifyResult
+	if err = verifyTree(&buf, fl, outDir, o, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.extra != 1 || !bytes.Contains(buf.Bytes(), []byte("gone")) {
+		t.Errorf("got %d extra files, want only gone:\n%s", res.extra, buf.String())
+	}
+	if res.ok != 2 || res.missing != 0 || res.mismatched != 0 {
+		t.Errorf("got %d up-to-date, %d missing and %d different files, want 2, 0 and 0:\n%s", res.ok, res.missing, res.mismatched, buf.String())
+	}
+}
+
+func TestVerifyTreeDates(t *testing.T) {
+	d := newFakeDuet(map[string]string{
+		"0:/sys/bed.g":     "G29\n",
+		"0:/sys/config.g":  "G28\n",
+		"0:/sys/homeall.g": "G28 X Y\n",
+	})
+	defer d.close()
+
+	outDir, remove := tempDir(t)
+	defer remove()
+	o := testOptions(outDir)
+	if err := syncFolder(d.URL(), sysDir, outDir, o); err != nil {
+		t.Fatal(err)
+	}
+
+	// Emulate a filesystem that rounds mtimes for config.g, whose mtime
+	// was recorded when writing it, and an outdated homeall.g
+	rounded := fakeDate.Add(time.Second)
+	if err := os.Chtimes(filepath.Join(outDir, "config.g"), rounded, rounded); err != nil {
+		t.Fatal(err)
+	}
+	o.m.Files["0:/sys/config.g"].LocalMtime = &rounded
+	older := fakeDate.Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(outDir, "homeall.g"), older, older); err != nil {
+		t.Fatal(err)
+	}
+
+	// A different size alone would not make a sync update bed.g
+	d.setFile("0:/sys/bed.g", "G29 S1\n", fakeDate)
+
+	fl, err := listTree(d.URL(), sysDir, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	var res verifyResult
+	if err = verifyTree(&buf, fl, outDir, o, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ok != 1 || res.mismatched != 1 || !bytes.Contains(buf.Bytes(), []byte("homeall.g")) {
+		t.Errorf("got %d up-to-date and %d different files, want config.g and homeall.g:\n%s", res.ok, res.mismatched, buf.String())
+	}
+	if res.sizeOnly != 1 || !bytes.Contains(buf.Bytes(), []byte("bed.g")) {
+		t.Errorf("got %d files differing only in size, want bed.g:\n%s", res.sizeOnly, buf.String())
+	}
+}
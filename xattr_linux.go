@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const xattrsSupported = true
+
+// xattrsUnsupported makes sure the lack of support of the filesystem is
+// reported only once
+var xattrsUnsupported sync.Once
+
+// storeXattrs saves the size and date reported by the Duet as extended
+// attributes of the local file. A filesystem without support for extended
+// attributes is reported once and otherwise ignored.
+func storeXattrs(path string, size uint64, date time.Time) error {
+	err := syscall.Setxattr(path, "user.duet.size", []byte(strconv.FormatUint(size, 10)), 0)
+	if err == nil {
+		err = syscall.Setxattr(path, "user.duet.mtime", []byte(date.Format(time.RFC3339)), 0)
+	}
+	if err == syscall.ENOTSUP {
+		xattrsUnsupported.Do(func() {
+			log.Println("The filesystem of", path, "does not support extended attributes, -storeXattrs has no effect")
+		})
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const xattrsSupported = false
+
+// storeXattrs fails on platforms where the standard library provides no
+// access to extended attributes. -storeXattrs is disabled with a warning
+// on these so it is not called.
+func storeXattrs(path string, size uint64, date time.Time) error {
+	return errors.New("extended attributes are not supported on this platform")
+}